@@ -0,0 +1,50 @@
+// Command protocol-spec writes the relay protocol as an AsyncAPI document
+// with JSON Schema payloads, generated from the protocol package, for client
+// code generators. A running relay serves the same document at
+// /api/v1/protocol.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"log"
+	"os"
+
+	"github.com/openclaw/openclaw-relay/internal/protocol"
+)
+
+// version is set at build time, see the Makefile.
+var version = "dev"
+
+func main() {
+	routesPath := flag.String("routes", "", "Routing table JSON file (empty = built-in)")
+	protoVersion := flag.Int("version", protocol.ProtocolVersion, "Protocol version to describe")
+	out := flag.String("o", "", "Output file (empty = stdout)")
+	flag.Parse()
+
+	routes := protocol.DefaultRoutingTable()
+	if *routesPath != "" {
+		var err error
+		routes, err = protocol.LoadRoutingTable(*routesPath)
+		if err != nil {
+			log.Fatalf("Failed to load routing table: %v", err)
+		}
+	}
+	spec, err := protocol.Spec(routes, *protoVersion, version)
+	if err != nil {
+		log.Fatalf("Failed to generate specification: %v", err)
+	}
+	data, err := json.MarshalIndent(spec, "", "  ")
+	if err != nil {
+		log.Fatalf("Failed to encode specification: %v", err)
+	}
+	data = append(data, '\n')
+
+	if *out == "" {
+		os.Stdout.Write(data)
+		return
+	}
+	if err := os.WriteFile(*out, data, 0o644); err != nil {
+		log.Fatalf("Failed to write %s: %v", *out, err)
+	}
+}
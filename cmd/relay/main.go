@@ -6,19 +6,46 @@ import (
 	"log"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
+	"github.com/openclaw/openclaw-relay/internal/cluster"
 	"github.com/openclaw/openclaw-relay/internal/hub"
+	"github.com/openclaw/openclaw-relay/internal/protocol"
 	"github.com/openclaw/openclaw-relay/internal/server"
 	"github.com/openclaw/openclaw-relay/internal/store"
 )
 
+// version is set at build time, see the Makefile.
+var version = "dev"
+
 func main() {
 	addr := flag.String("addr", ":8443", "Listen address")
 	domain := flag.String("domain", "", "TLS domain (empty = no TLS)")
 	dbPath := flag.String("db", "relay.db", "SQLite database path")
 	adminKey := flag.String("admin-key", os.Getenv("RELAY_ADMIN_KEY"), "Admin API key")
+	routesPath := flag.String("routes", "", "Routing table JSON file (empty = built-in)")
+	agentBalance := flag.String("agent-balance", hub.BalanceRoundRobin, "Agent pool balance policy (round_robin, least_loaded)")
+	offlineQueue := flag.Bool("offline-queue", false, "Queue messages for offline peers and replay them on reconnect")
+	queueMaxMessages := flag.Int("queue-max-messages", hub.DefaultQueueMaxMessages, "Offline queue limit per token and role (messages)")
+	queueMaxBytes := flag.Int64("queue-max-bytes", hub.DefaultQueueMaxBytes, "Offline queue limit per token and role (bytes)")
+	queueTTL := flag.Duration("queue-ttl", hub.DefaultQueueTTL, "How long queued messages are kept")
+	replayFrames := flag.Int("replay-frames", hub.DefaultReplayFrames, "Frames kept per session direction for resuming clients")
+	replayBytes := flag.Int64("replay-bytes", hub.DefaultReplayBytes, "Bytes kept per session direction for resuming clients")
+	strictPayloads := flag.Bool("strict-payloads", false, "Reject unencrypted payloads that do not match their message type's schema")
+	maxFileSize := flag.Int64("max-file-size", hub.DefaultMaxFileSize, "Largest file accepted for transfer (bytes)")
+	takeover := flag.String("takeover", hub.TakeoverReplace, "Default policy when a device connects twice (replace, reject, allow_both)")
+	requestTimeout := flag.Duration("request-timeout", hub.DefaultRequestTimeout, "How long requests wait for their result unless the route sets a timeout")
+	drainTimeout := flag.Duration("drain-timeout", 10*time.Second, "How long shutdown waits for in-flight streams")
+	reconnectBackoff := flag.Duration("reconnect-backoff", hub.DefaultReconnectBackoff, "Reconnect delay suggested to clients on shutdown")
+	compress := flag.Bool("compress", false, "Offer permessage-deflate compression to clients")
+	compressLevel := flag.Int("compress-level", 1, "Compression level, 1 (fastest) to 9 (best)")
+	compressThreshold := flag.Int("compress-threshold", hub.DefaultCompressionThreshold, "Smallest frame compressed (bytes)")
+	meterWireBytes := flag.Bool("meter-wire-bytes", false, "Charge the bandwidth quota with compressed bytes on the wire")
+	clusterSelf := flag.String("cluster-self", "", "This node's base URL as peers reach it, e.g. http://10.0.0.1:8443 (empty = no cluster)")
+	clusterPeers := flag.String("cluster-peers", "", "Comma-separated base URLs of all cluster nodes")
+	clusterSecret := flag.String("cluster-secret", os.Getenv("RELAY_CLUSTER_SECRET"), "Shared secret for internal cluster links")
 	flag.Parse()
 
 	db, err := store.NewSQLiteStore(*dbPath)
@@ -27,13 +54,66 @@ func main() {
 	}
 	defer db.Close()
 
-	h := hub.NewHub(db)
+	cfg := hub.Config{
+		AgentBalance:     *agentBalance,
+		ReplayFrames:     *replayFrames,
+		ReplayBytes:      *replayBytes,
+		Takeover:         *takeover,
+		RequestTimeout:   *requestTimeout,
+		ReconnectBackoff: *reconnectBackoff,
+		StrictPayloads:   *strictPayloads,
+		MaxFileSize:      *maxFileSize,
+		MeterWireBytes:   *meterWireBytes,
+	}
+	if !hub.ValidTakeover(*takeover) {
+		log.Fatalf("Invalid takeover policy: %s", *takeover)
+	}
+	var compression *hub.Compression
+	if *compress {
+		if *compressLevel < 1 || *compressLevel > 9 {
+			log.Fatalf("Invalid compression level: %d", *compressLevel)
+		}
+		compression = &hub.Compression{Level: *compressLevel, Threshold: *compressThreshold}
+	}
+	if *routesPath != "" {
+		routes, err := protocol.LoadRoutingTable(*routesPath)
+		if err != nil {
+			log.Fatalf("Failed to load routing table: %v", err)
+		}
+		cfg.Routes = routes
+	}
+	if *offlineQueue {
+		cfg.OfflineQueue = hub.OfflineQueue{
+			Mailbox:     db,
+			MaxMessages: *queueMaxMessages,
+			MaxBytes:    *queueMaxBytes,
+			TTL:         *queueTTL,
+		}
+	}
+	var node *cluster.Cluster
+	if *clusterSelf != "" {
+		node, err = cluster.New(cluster.Config{
+			Self:   *clusterSelf,
+			Peers:  strings.Split(*clusterPeers, ","),
+			Secret: *clusterSecret,
+		})
+		if err != nil {
+			log.Fatalf("Invalid cluster configuration: %v", err)
+		}
+		cfg.OwnsToken = node.Owns
+		log.Printf("Cluster node %s of %d", node.Self(), len(node.Nodes()))
+	}
+	h := hub.NewHubWithConfig(db, cfg)
 
 	srv := server.New(h, server.Config{
-		Addr:      *addr,
-		TLSDomain: *domain,
-		AdminKey:  *adminKey,
-		DBPath:    *dbPath,
+		Addr:         *addr,
+		TLSDomain:    *domain,
+		AdminKey:     *adminKey,
+		DBPath:       *dbPath,
+		Cluster:      node,
+		DrainTimeout: *drainTimeout,
+		Compression:  compression,
+		Version:      version,
 	})
 
 	stop := make(chan os.Signal, 1)
@@ -50,7 +130,8 @@ func main() {
 	<-stop
 	log.Println("Shutting down...")
 
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	// Leave time to close connections after waiting for streams
+	ctx, cancel := context.WithTimeout(context.Background(), *drainTimeout+5*time.Second)
 	defer cancel()
 	srv.Shutdown(ctx)
 }
@@ -0,0 +1,53 @@
+package cluster
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestVerifySignature(t *testing.T) {
+	r, _ := http.NewRequest(http.MethodGet, "http://a:1"+LinkPath, nil)
+	Sign(r, "http://b:1", "secret")
+
+	node, err := Verify(r, "secret")
+	if err != nil || node != "http://b:1" {
+		t.Fatalf("Verify = %q, %v", node, err)
+	}
+	if _, err := Verify(r, "other"); err == nil {
+		t.Error("expected wrong secret to be rejected")
+	}
+	r.Header.Del(HeaderSignature)
+	if _, err := Verify(r, "secret"); err == nil {
+		t.Error("expected unsigned request to be rejected")
+	}
+}
+
+func TestSignatureBoundToRequest(t *testing.T) {
+	r, _ := http.NewRequest(http.MethodPost, "http://a:1/api/v1/broadcast", strings.NewReader(`{"message":"hi"}`))
+	Sign(r, "http://b:1", "secret")
+	if _, err := Verify(r, "secret"); err != nil {
+		t.Fatalf("Verify failed: %v", err)
+	}
+	if body, _ := io.ReadAll(r.Body); string(body) != `{"message":"hi"}` {
+		t.Fatalf("Verify must leave the body readable, got %q", body)
+	}
+
+	replay := func(method, target, body string) *http.Request {
+		other, _ := http.NewRequest(method, target, strings.NewReader(body))
+		for _, h := range []string{HeaderNode, HeaderTime, HeaderSignature} {
+			other.Header.Set(h, r.Header.Get(h))
+		}
+		return other
+	}
+	for _, other := range []*http.Request{
+		replay(http.MethodPost, "http://a:1/api/v1/broadcast", `{"message":"pwned"}`),
+		replay(http.MethodPost, "http://a:1/api/v1/pair", `{"message":"hi"}`),
+		replay(http.MethodPut, "http://a:1/api/v1/broadcast", `{"message":"hi"}`),
+	} {
+		if _, err := Verify(other, "secret"); err == nil {
+			t.Errorf("signature reused for %s %s", other.Method, other.URL.Path)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+// Package cluster lets several relay nodes share the load of one deployment.
+// Every node is given the same static peer list and agrees, by consistent
+// hashing, on which node owns each pairing token. Connections that land on
+// another node are forwarded to the owner over an authenticated internal link.
+package cluster
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Config describes this node's place in a cluster.
+type Config struct {
+	// Self is this node's base URL as the other nodes reach it, for
+	// example "http://10.0.0.1:8443".
+	Self string
+	// Peers lists the base URLs of every node. Self is added if missing.
+	Peers []string
+	// Secret is shared by all nodes and authenticates internal links.
+	Secret string
+	// Replicas is the number of ring points per node (0 = DefaultReplicas).
+	Replicas int
+}
+
+// Cluster answers token ownership questions for one node.
+type Cluster struct {
+	self   string
+	nodes  []string
+	secret string
+	ring   *Ring
+}
+
+// New validates cfg and builds the node's view of the cluster.
+func New(cfg Config) (*Cluster, error) {
+	if cfg.Secret == "" {
+		return nil, errors.New("cluster secret is required")
+	}
+	self := strings.TrimSuffix(cfg.Self, "/")
+	if err := checkNode(self); err != nil {
+		return nil, err
+	}
+	nodes := []string{self}
+	for _, p := range cfg.Peers {
+		p = strings.TrimSuffix(strings.TrimSpace(p), "/")
+		if p == "" || p == self {
+			continue
+		}
+		if err := checkNode(p); err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, p)
+	}
+	return &Cluster{
+		self:   self,
+		nodes:  nodes,
+		secret: cfg.Secret,
+		ring:   NewRing(nodes, cfg.Replicas),
+	}, nil
+}
+
+func checkNode(node string) error {
+	u, err := url.Parse(node)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid cluster node %q: want http(s)://host:port", node)
+	}
+	return nil
+}
+
+// Self returns this node's base URL.
+func (c *Cluster) Self() string { return c.self }
+
+// Nodes returns the base URLs of every node, this one first.
+func (c *Cluster) Nodes() []string { return c.nodes }
+
+// Peers returns the base URLs of every other node.
+func (c *Cluster) Peers() []string { return c.nodes[1:] }
+
+// NewRequest builds a request to another node, signed as coming from this
+// node.
+func (c *Cluster) NewRequest(method, node, path string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, node+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if err := Sign(req, c.self, c.secret); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+// Owner returns the node that owns a token.
+func (c *Cluster) Owner(token string) string { return c.ring.Owner(token) }
+
+// Owns reports whether this node owns a token.
+func (c *Cluster) Owns(token string) bool { return c.ring.Owner(token) == c.self }
+
+// Verify checks that r came from another node of this cluster.
+func (c *Cluster) Verify(r *http.Request) error {
+	_, err := Verify(r, c.secret)
+	return err
+}
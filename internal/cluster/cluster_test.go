@@ -0,0 +1,250 @@
+package cluster_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/openclaw/openclaw-relay/internal/cluster"
+	"github.com/openclaw/openclaw-relay/internal/hub"
+	"github.com/openclaw/openclaw-relay/internal/protocol"
+	"github.com/openclaw/openclaw-relay/internal/server"
+	"github.com/openclaw/openclaw-relay/internal/store"
+)
+
+type testNode struct {
+	url     string
+	cluster *cluster.Cluster
+}
+
+// startCluster runs n relay nodes on localhost, each with its own database.
+func startCluster(t *testing.T, n int) []testNode {
+	t.Helper()
+	return startClusterWith(t, n, server.Config{})
+}
+
+// startClusterWith is startCluster with cfg as every node's server
+// configuration.
+func startClusterWith(t *testing.T, n int, cfg server.Config) []testNode {
+	t.Helper()
+	servers := make([]*httptest.Server, n)
+	urls := make([]string, n)
+	for i := range servers {
+		servers[i] = httptest.NewUnstartedServer(nil)
+		urls[i] = "http://" + servers[i].Listener.Addr().String()
+	}
+
+	nodes := make([]testNode, n)
+	for i, ts := range servers {
+		c, err := cluster.New(cluster.Config{Self: urls[i], Peers: urls, Secret: "test-secret"})
+		if err != nil {
+			t.Fatalf("cluster.New: %v", err)
+		}
+		db, err := store.NewSQLiteStore(filepath.Join(t.TempDir(), "relay.db"))
+		if err != nil {
+			t.Fatalf("NewSQLiteStore: %v", err)
+		}
+		t.Cleanup(func() { db.Close() })
+		h := hub.NewHubWithConfig(db, hub.Config{OwnsToken: c.Owns})
+		cfg.Cluster = c
+		srv := server.New(h, cfg)
+		ts.Config.Handler = srv.Handler()
+		ts.Start()
+		t.Cleanup(ts.Close)
+		nodes[i] = testNode{url: urls[i], cluster: c}
+	}
+	return nodes
+}
+
+func dialRelay(t *testing.T, node testNode, token, role string) *websocket.Conn {
+	t.Helper()
+	ws, _, err := websocket.DefaultDialer.Dial(strings.Replace(node.url, "http", "ws", 1)+"/ws", nil)
+	if err != nil {
+		t.Fatalf("dial %s: %v", node.url, err)
+	}
+	t.Cleanup(func() { ws.Close() })
+	auth, _ := protocol.NewEnvelope(protocol.TypeAuth, protocol.AuthPayload{Token: token, Role: role})
+	data, _ := auth.Marshal()
+	if err := ws.WriteMessage(websocket.TextMessage, data); err != nil {
+		t.Fatalf("send auth: %v", err)
+	}
+	if env := readType(t, ws, protocol.TypeAuthOk, protocol.TypeAuthFail); env.Type != protocol.TypeAuthOk {
+		t.Fatalf("auth via %s failed: %s", node.url, env.Payload)
+	}
+	return ws
+}
+
+// readType reads frames until one of the given types arrives.
+func readType(t *testing.T, ws *websocket.Conn, types ...string) *protocol.Envelope {
+	t.Helper()
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		_, data, err := ws.ReadMessage()
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		var env protocol.Envelope
+		if err := json.Unmarshal(data, &env); err != nil {
+			t.Fatalf("invalid frame: %v", err)
+		}
+		for _, typ := range types {
+			if env.Type == typ {
+				return &env
+			}
+		}
+	}
+}
+
+func TestClusterRoutesPeersOnDifferentNodes(t *testing.T) {
+	nodes := startCluster(t, 3)
+
+	req, _ := http.NewRequest(http.MethodPost, nodes[0].url+"/api/v1/pair", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("create token: %v", err)
+	}
+	var created map[string]string
+	json.NewDecoder(resp.Body).Decode(&created)
+	resp.Body.Close()
+	token := created["token"]
+	if !nodes[0].cluster.Owns(token) {
+		t.Fatalf("node 0 issued token %s owned by %s", token, nodes[0].cluster.Owner(token))
+	}
+
+	// Neither peer connects to the owning node.
+	phone := dialRelay(t, nodes[1], token, protocol.RolePhone)
+	agent := dialRelay(t, nodes[2], token, protocol.RoleAgent)
+
+	send, _ := protocol.NewEnvelope(protocol.TypeChatSend, protocol.ChatSendPayload{Text: "hello"})
+	data, _ := send.Marshal()
+	if err := phone.WriteMessage(websocket.TextMessage, data); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	got := readType(t, agent, protocol.TypeChatSend)
+	var payload protocol.ChatSendPayload
+	if err := got.ParsePayload(&payload); err != nil || payload.Text != "hello" {
+		t.Errorf("agent got %s, want hello", got.Payload)
+	}
+
+	resp, err = http.Get(nodes[2].url + "/api/v1/pair/" + token)
+	if err != nil {
+		t.Fatalf("token status: %v", err)
+	}
+	var status map[string]bool
+	json.NewDecoder(resp.Body).Decode(&status)
+	resp.Body.Close()
+	if !status["phone"] || !status["agent"] {
+		t.Errorf("status via non-owner = %v, want both online", status)
+	}
+
+	// A broadcast on any node reaches sessions on every node
+	resp, err = http.Post(nodes[1].url+"/api/v1/broadcast", "application/json",
+		strings.NewReader(`{"message":"maintenance","role":"phone"}`))
+	if err != nil {
+		t.Fatalf("broadcast: %v", err)
+	}
+	var result hub.BroadcastResult
+	json.NewDecoder(resp.Body).Decode(&result)
+	resp.Body.Close()
+	if result.Sessions != 1 || result.Delivered != 1 {
+		t.Errorf("broadcast result = %+v, want one phone", result)
+	}
+	readType(t, phone, protocol.TypeSystemNotice)
+}
+
+func TestClusterLinkRequiresSignature(t *testing.T) {
+	nodes := startCluster(t, 2)
+	resp, err := http.Get(nodes[0].url + cluster.LinkPath)
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("unsigned link status = %d, want 401", resp.StatusCode)
+	}
+}
+
+func TestClusterBroadcastNeedsAdminKey(t *testing.T) {
+	nodes := startClusterWith(t, 2, server.Config{AdminKey: "admin"})
+
+	req, _ := http.NewRequest(http.MethodPost, nodes[0].url+"/api/v1/pair", nil)
+	req.Header.Set("X-Admin-Key", "admin")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("create token: %v", err)
+	}
+	var created map[string]string
+	json.NewDecoder(resp.Body).Decode(&created)
+	resp.Body.Close()
+	dialRelay(t, nodes[0], created["token"], protocol.RolePhone)
+
+	// A peer signature alone does not authorize a broadcast
+	body := `{"message":"maintenance"}`
+	req, _ = nodes[1].cluster.NewRequest(http.MethodPost, nodes[0].url, "/api/v1/broadcast", strings.NewReader(body))
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("broadcast: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("signed broadcast without admin key status = %d, want 401", resp.StatusCode)
+	}
+
+	// The admin key is passed on to the other nodes
+	req, _ = http.NewRequest(http.MethodPost, nodes[1].url+"/api/v1/broadcast", strings.NewReader(body))
+	req.Header.Set("X-Admin-Key", "admin")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("broadcast: %v", err)
+	}
+	var result hub.BroadcastResult
+	json.NewDecoder(resp.Body).Decode(&result)
+	resp.Body.Close()
+	if result.Sessions != 1 {
+		t.Errorf("broadcast result = %+v, want the phone on node 0", result)
+	}
+}
+
+func TestClusterProxiesCompressedClients(t *testing.T) {
+	nodes := startClusterWith(t, 2, server.Config{Compression: &hub.Compression{Level: 1, Threshold: 64}})
+
+	resp, err := http.Post(nodes[0].url+"/api/v1/pair", "application/json", nil)
+	if err != nil {
+		t.Fatalf("create token: %v", err)
+	}
+	var created map[string]string
+	json.NewDecoder(resp.Body).Decode(&created)
+	resp.Body.Close()
+	token := created["token"]
+
+	// The phone negotiates compression with the node that does not own its token
+	dialer := websocket.Dialer{EnableCompression: true}
+	phone, wsResp, err := dialer.Dial(strings.Replace(nodes[1].url, "http", "ws", 1)+"/ws", nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { phone.Close() })
+	if !strings.Contains(wsResp.Header.Get("Sec-WebSocket-Extensions"), "permessage-deflate") {
+		t.Fatal("expected permessage-deflate to be negotiated")
+	}
+	auth, _ := protocol.NewEnvelope(protocol.TypeAuth, protocol.AuthPayload{Token: token, Role: protocol.RolePhone})
+	data, _ := auth.Marshal()
+	phone.WriteMessage(websocket.TextMessage, data)
+	readType(t, phone, protocol.TypeAuthOk)
+	agent := dialRelay(t, nodes[0], token, protocol.RoleAgent)
+
+	text := strings.Repeat("compress me ", 500)
+	chunk, _ := protocol.NewEnvelope(protocol.TypeChatStream, protocol.ChatStreamPayload{Delta: text, Seq: 1})
+	data, _ = chunk.Marshal()
+	agent.WriteMessage(websocket.TextMessage, data)
+	got := readType(t, phone, protocol.TypeChatStream)
+	var payload protocol.ChatStreamPayload
+	if err := got.ParsePayload(&payload); err != nil || payload.Delta != text {
+		t.Errorf("phone got a %d byte delta, want %d", len(payload.Delta), len(text))
+	}
+}
@@ -0,0 +1,142 @@
+package cluster
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// LinkPath is the WebSocket endpoint on which a node accepts connections
+// forwarded by other nodes.
+const LinkPath = "/cluster/ws"
+
+const (
+	writeWait   = 10 * time.Second
+	dialTimeout = 5 * time.Second
+)
+
+var dialer = websocket.Dialer{
+	HandshakeTimeout: dialTimeout,
+	ReadBufferSize:   4096,
+	WriteBufferSize:  4096,
+}
+
+// Dial opens a link to owner for a client connection and sends the client's
+// first frame (its auth message) over it. query describes the client
+// connection to the owner and is covered by the link signature.
+func (c *Cluster) Dial(owner string, first []byte, query url.Values) (*websocket.Conn, error) {
+	u, err := url.Parse(owner)
+	if err != nil {
+		return nil, err
+	}
+	u.Scheme = strings.Replace(u.Scheme, "http", "ws", 1)
+	u.Path = LinkPath
+	u.RawQuery = query.Encode()
+
+	header := http.Header{}
+	signHeader(header, c.self, c.secret, http.MethodGet, u.RequestURI(), nil)
+	ws, _, err := dialer.Dial(u.String(), header)
+	if err != nil {
+		return nil, err
+	}
+	ws.SetWriteDeadline(time.Now().Add(writeWait))
+	if err := ws.WriteMessage(websocket.TextMessage, first); err != nil {
+		ws.Close()
+		return nil, err
+	}
+	return ws, nil
+}
+
+// Pipe relays frames between a client and its link to the owning node until
+// either side closes. Pings and pongs are passed through, so liveness is
+// checked end to end, and close codes are forwarded to the other side. If the
+// client negotiated compression, frames of at least compressAt bytes are sent
+// to it compressed.
+func Pipe(client, upstream *websocket.Conn, compressAt int) {
+	client.SetReadDeadline(time.Time{})
+	passControl(client, upstream)
+	passControl(upstream, client)
+
+	done := make(chan struct{}, 2)
+	go func() {
+		copyFrames(upstream, client, 0)
+		done <- struct{}{}
+	}()
+	go func() {
+		copyFrames(client, upstream, compressAt)
+		done <- struct{}{}
+	}()
+	<-done
+	client.Close()
+	upstream.Close()
+	<-done
+}
+
+// passControl forwards pings and pongs read from src to dst.
+func passControl(src, dst *websocket.Conn) {
+	src.SetPingHandler(func(data string) error {
+		return writeControl(dst, websocket.PingMessage, []byte(data))
+	})
+	src.SetPongHandler(func(data string) error {
+		return writeControl(dst, websocket.PongMessage, []byte(data))
+	})
+}
+
+func writeControl(ws *websocket.Conn, messageType int, data []byte) error {
+	err := ws.WriteControl(messageType, data, time.Now().Add(writeWait))
+	if errors.Is(err, websocket.ErrCloseSent) {
+		return nil
+	}
+	return err
+}
+
+// copyFrames copies data frames from src to dst, compressing those of at least
+// compressAt bytes if dst negotiated compression. When src closes, the close
+// code is passed on to dst.
+func copyFrames(dst, src *websocket.Conn, compressAt int) {
+	for {
+		messageType, data, err := src.ReadMessage()
+		if err != nil {
+			msg := websocket.FormatCloseMessage(websocket.CloseGoingAway, "")
+			var ce *websocket.CloseError
+			if errors.As(err, &ce) && ce.Code != websocket.CloseNoStatusReceived && ce.Code != websocket.CloseAbnormalClosure {
+				msg = websocket.FormatCloseMessage(ce.Code, ce.Text)
+			}
+			writeControl(dst, websocket.CloseMessage, msg)
+			return
+		}
+		dst.SetWriteDeadline(time.Now().Add(writeWait))
+		dst.EnableWriteCompression(len(data) >= compressAt)
+		if err := dst.WriteMessage(messageType, data); err != nil {
+			return
+		}
+	}
+}
+
+// Forward proxies an HTTP request to the owning node, signed as coming from
+// this node.
+func (c *Cluster) Forward(w http.ResponseWriter, r *http.Request, owner string) {
+	target, err := url.Parse(owner)
+	if err != nil {
+		http.Error(w, "Invalid cluster node", http.StatusBadGateway)
+		return
+	}
+	if _, err := readBody(r); err != nil {
+		http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetURL(target)
+			pr.Out.Host = target.Host
+			// Cannot fail, the body was read once already
+			Sign(pr.Out, c.self, c.secret)
+		},
+	}
+	proxy.ServeHTTP(w, r)
+}
@@ -0,0 +1,57 @@
+package cluster
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"sort"
+	"strconv"
+)
+
+// DefaultReplicas is the number of virtual points each node gets on the ring.
+const DefaultReplicas = 128
+
+// Ring assigns pairing tokens to nodes by consistent hashing, so adding or
+// removing a node only moves the tokens that hashed next to it.
+type Ring struct {
+	points []uint64
+	owners map[uint64]string
+}
+
+// NewRing builds a ring over the given nodes with replicas virtual points per
+// node. Every node must use the same node list to agree on ownership.
+func NewRing(nodes []string, replicas int) *Ring {
+	if replicas <= 0 {
+		replicas = DefaultReplicas
+	}
+	r := &Ring{owners: make(map[uint64]string)}
+	for _, node := range nodes {
+		for i := 0; i < replicas; i++ {
+			p := hashKey(node + "#" + strconv.Itoa(i))
+			if _, taken := r.owners[p]; taken {
+				continue
+			}
+			r.owners[p] = node
+			r.points = append(r.points, p)
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool { return r.points[i] < r.points[j] })
+	return r
+}
+
+// Owner returns the node responsible for key, or "" for an empty ring.
+func (r *Ring) Owner(key string) string {
+	if len(r.points) == 0 {
+		return ""
+	}
+	h := hashKey(key)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.owners[r.points[i]]
+}
+
+func hashKey(key string) uint64 {
+	sum := sha256.Sum256([]byte(key))
+	return binary.BigEndian.Uint64(sum[:8])
+}
@@ -0,0 +1,39 @@
+package cluster
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestRingOwnerIsStableAndSpread(t *testing.T) {
+	nodes := []string{"http://a:1", "http://b:1", "http://c:1"}
+	r1 := NewRing(nodes, 0)
+	r2 := NewRing([]string{nodes[2], nodes[0], nodes[1]}, 0)
+
+	counts := make(map[string]int)
+	for i := 0; i < 3000; i++ {
+		key := fmt.Sprintf("oc_pair_%d", i)
+		owner := r1.Owner(key)
+		if owner != r2.Owner(key) {
+			t.Fatalf("owner of %s depends on node order", key)
+		}
+		counts[owner]++
+	}
+	for _, n := range nodes {
+		if counts[n] < 600 {
+			t.Errorf("node %s owns only %d of 3000 keys", n, counts[n])
+		}
+	}
+}
+
+func TestRingRemovingNodeOnlyMovesItsKeys(t *testing.T) {
+	full := NewRing([]string{"http://a:1", "http://b:1", "http://c:1"}, 0)
+	reduced := NewRing([]string{"http://a:1", "http://b:1"}, 0)
+
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("oc_pair_%d", i)
+		if owner := full.Owner(key); owner != "http://c:1" && reduced.Owner(key) != owner {
+			t.Fatalf("key %s moved from %s although its node stayed", key, owner)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package hub
+
+import "github.com/openclaw/openclaw-relay/internal/protocol"
+
+// Balance policies choose an agent connection for phone messages that do not
+// name an agent served by the pool.
+const (
+	BalanceRoundRobin  = "round_robin"
+	BalanceLeastLoaded = "least_loaded"
+)
+
+// routeToAgent picks the agent connection for a phone message. Messages whose
+// payload names an agent_id go to the connection serving that agent; anything
+// else is spread across the pool by the hub's balance policy.
+func (h *Hub) routeToAgent(session *Session, env *protocol.Envelope) *Connection {
+	agents := session.Conns(protocol.RoleAgent)
+	if len(agents) == 0 {
+		return nil
+	}
+	if len(agents) == 1 {
+		return agents[0]
+	}
+
+	if agentID := env.AgentID(); agentID != "" {
+		for _, a := range agents {
+			for _, id := range a.AgentIDs {
+				if id == agentID {
+					return a
+				}
+			}
+		}
+	}
+
+	switch h.config.AgentBalance {
+	case BalanceLeastLoaded:
+		best := agents[0]
+		for _, a := range agents[1:] {
+			if a.Pending() < best.Pending() {
+				best = a
+			}
+		}
+		return best
+	default:
+		n := session.nextAgent.Add(1) - 1
+		return agents[n%uint64(len(agents))]
+	}
+}
@@ -0,0 +1,88 @@
+package hub
+
+import (
+	"log"
+
+	"github.com/openclaw/openclaw-relay/internal/protocol"
+)
+
+// BroadcastFilter selects the connections a broadcast reaches. Empty fields
+// match everything.
+type BroadcastFilter struct {
+	Tokens []string
+	Role   string
+}
+
+// BroadcastResult counts the outcome of a broadcast.
+type BroadcastResult struct {
+	Sessions  int `json:"sessions"`  // sessions with at least one matching connection
+	Delivered int `json:"delivered"` // connections the notice was queued on
+	Dropped   int `json:"dropped"`   // connections whose control lane was full
+}
+
+// Add sums two results.
+func (r BroadcastResult) Add(o BroadcastResult) BroadcastResult {
+	return BroadcastResult{
+		Sessions:  r.Sessions + o.Sessions,
+		Delivered: r.Delivered + o.Delivered,
+		Dropped:   r.Dropped + o.Dropped,
+	}
+}
+
+// Broadcast queues a system.notice on every connection matching filter.
+func (h *Hub) Broadcast(notice protocol.NoticePayload, filter BroadcastFilter) (BroadcastResult, error) {
+	var result BroadcastResult
+	env, err := protocol.NewEnvelope(protocol.TypeSystemNotice, notice)
+	if err != nil {
+		return result, err
+	}
+	data, err := env.Marshal()
+	if err != nil {
+		return result, err
+	}
+
+	for _, session := range h.matchSessions(filter.Tokens) {
+		var conns []*Connection
+		if filter.Role == "" || filter.Role == protocol.RolePhone {
+			conns = append(conns, session.Conns(protocol.RolePhone)...)
+		}
+		if filter.Role == "" || filter.Role == protocol.RoleAgent {
+			conns = append(conns, session.Conns(protocol.RoleAgent)...)
+		}
+		if len(conns) == 0 {
+			continue
+		}
+		result.Sessions++
+		for _, conn := range conns {
+			if conn.Enqueue(Frame{Data: data, Lane: LaneControl}) {
+				result.Delivered++
+			} else {
+				result.Dropped++
+			}
+		}
+	}
+	log.Printf("broadcast: sessions=%d delivered=%d dropped=%d", result.Sessions, result.Delivered, result.Dropped)
+	return result, nil
+}
+
+// matchSessions returns the sessions for tokens, or every session if tokens
+// is empty.
+func (h *Hub) matchSessions(tokens []string) []*Session {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	var sessions []*Session
+	if len(tokens) == 0 {
+		for _, session := range h.sessions {
+			sessions = append(sessions, session)
+		}
+		return sessions
+	}
+	seen := make(map[string]bool, len(tokens))
+	for _, token := range tokens {
+		if session, ok := h.sessions[token]; ok && !seen[token] {
+			seen[token] = true
+			sessions = append(sessions, session)
+		}
+	}
+	return sessions
+}
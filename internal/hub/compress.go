@@ -0,0 +1,60 @@
+package hub
+
+import (
+	"compress/flate"
+	"sync"
+)
+
+// DefaultCompressionThreshold is the smallest frame worth compressing when
+// no threshold is configured.
+const DefaultCompressionThreshold = 512
+
+// Compression configures permessage-deflate for connections that negotiate it.
+type Compression struct {
+	Level     int // flate level, 1 (fastest) to 9 (best)
+	Threshold int // frames smaller than this many bytes are sent uncompressed
+}
+
+// Compresses reports whether a frame of n bytes is sent compressed on the
+// connection.
+func (c *Connection) Compresses(n int) bool {
+	return c.Deflate != nil && n >= c.Deflate.Threshold
+}
+
+// WireSize returns the size of a frame's payload on the connection's socket:
+// its deflated size if the connection compresses it, otherwise its length.
+func (c *Connection) WireSize(f Frame) int64 {
+	if !c.Compresses(len(f.Data)) {
+		return int64(len(f.Data))
+	}
+	return deflatedSize(f.Data, c.Deflate.Level)
+}
+
+// flateWriters pools flate writers by level.
+var flateWriters [flate.BestCompression + 1]sync.Pool
+
+type byteCounter int64
+
+func (n *byteCounter) Write(p []byte) (int, error) {
+	*n += byteCounter(len(p))
+	return len(p), nil
+}
+
+// deflatedSize compresses data the way permessage-deflate does, a flushed
+// stream minus the 4 byte sync marker, and returns the compressed length.
+func deflatedSize(data []byte, level int) int64 {
+	if level < flate.BestSpeed || level > flate.BestCompression {
+		level = flate.BestSpeed
+	}
+	var n byteCounter
+	w, _ := flateWriters[level].Get().(*flate.Writer)
+	if w == nil {
+		w, _ = flate.NewWriter(&n, level)
+	} else {
+		w.Reset(&n)
+	}
+	w.Write(data)
+	w.Flush()
+	flateWriters[level].Put(w)
+	return int64(n) - 4
+}
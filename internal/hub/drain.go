@@ -0,0 +1,106 @@
+package hub
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math/rand"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/openclaw/openclaw-relay/internal/protocol"
+)
+
+// DefaultReconnectBackoff is the reconnect delay suggested to clients while
+// draining. Each client is given a random delay between one and two times
+// this value so they do not all come back at once.
+const DefaultReconnectBackoff = 2 * time.Second
+
+// drainPollInterval is how often Drain checks for finished streams and
+// closed connections.
+const drainPollInterval = 100 * time.Millisecond
+
+// ErrDraining is returned by Authenticate once the hub has started draining.
+var ErrDraining = errors.New("relay is shutting down")
+
+// Drain shuts the hub down gracefully. It stops accepting new connections,
+// sends every connected client a system.reconnect hint, and waits for chat
+// streams in flight to finish until streamDeadline. It then closes every
+// connection with CloseServiceRestart and waits, until ctx is done, for them
+// to disconnect.
+func (h *Hub) Drain(ctx context.Context, streamDeadline time.Time) {
+	h.draining.Store(true)
+
+	conns := h.allConns()
+	log.Printf("drain: %d connections, %d streams in flight", len(conns), h.streams.Load())
+	for _, conn := range conns {
+		h.sendReconnect(conn)
+	}
+
+	streamCtx, cancel := context.WithDeadline(ctx, streamDeadline)
+	defer cancel()
+	if !waitFor(streamCtx, func() bool { return h.streams.Load() == 0 }) {
+		log.Printf("drain: giving up on %d streams", h.streams.Load())
+	}
+
+	for _, conn := range h.allConns() {
+		conn.Close(websocket.CloseServiceRestart, "relay restarting")
+	}
+	if !waitFor(ctx, func() bool { return h.connCount.Load() == 0 }) {
+		log.Printf("drain: %d connections still open", h.connCount.Load())
+	}
+}
+
+// Draining reports whether Drain has been called.
+func (h *Hub) Draining() bool {
+	return h.draining.Load()
+}
+
+func (h *Hub) sendReconnect(conn *Connection) {
+	backoff := h.config.ReconnectBackoff
+	if backoff <= 0 {
+		backoff = DefaultReconnectBackoff
+	}
+	backoff += time.Duration(rand.Int63n(int64(backoff)))
+
+	env, err := protocol.NewEnvelope(protocol.TypeSystemReconnect, protocol.ReconnectPayload{
+		BackoffMs: backoff.Milliseconds(),
+		Reason:    "shutdown",
+	})
+	if err != nil {
+		log.Printf("error creating reconnect envelope: %v", err)
+		return
+	}
+	data, err := env.Marshal()
+	if err != nil {
+		log.Printf("error marshaling reconnect: %v", err)
+		return
+	}
+	conn.Enqueue(Frame{Data: data, Lane: LaneControl})
+}
+
+// allConns returns every connection of every session.
+func (h *Hub) allConns() []*Connection {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	var conns []*Connection
+	for _, session := range h.sessions {
+		conns = append(conns, session.Conns(protocol.RolePhone)...)
+		conns = append(conns, session.Conns(protocol.RoleAgent)...)
+	}
+	return conns
+}
+
+// waitFor polls done until it returns true or ctx ends, and reports which.
+func waitFor(ctx context.Context, done func() bool) bool {
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+	for !done() {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-ticker.C:
+		}
+	}
+	return true
+}
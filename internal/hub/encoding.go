@@ -0,0 +1,80 @@
+package hub
+
+import (
+	"log"
+
+	"github.com/openclaw/openclaw-relay/internal/protocol"
+)
+
+// Encode returns f in the protocol version and encoding the connection reads.
+// Frames are queued as version 1 JSON and converted either here, just before
+// they are written, or earlier by callers that need the final size; a frame
+// that fails to convert is sent as it is.
+func (c *Connection) Encode(f Frame) Frame {
+	if f.encoded {
+		return f
+	}
+	f.encoded = true
+	data := f.Data
+	if c.Version > protocol.ProtocolVersion {
+		versioned, err := protocol.ToVersion(data, c.Version)
+		if err != nil {
+			log.Printf("version %d encode error: %v", c.Version, err)
+			return f
+		}
+		data = versioned
+	}
+	if c.Encoding == protocol.EncodingCBOR {
+		binary, err := protocol.EncodeBinary(data)
+		if err != nil {
+			log.Printf("cbor encode error: %v", err)
+			return f
+		}
+		data, f.Binary = binary, true
+	}
+	f.Data = data
+	return f
+}
+
+// Decode converts a frame read from the connection to version 1 JSON, the
+// form the hub works with. Binary frames carry CBOR.
+func (c *Connection) Decode(data []byte, binary bool) ([]byte, error) {
+	if binary {
+		var err error
+		if data, err = protocol.DecodeBinary(data); err != nil {
+			return nil, err
+		}
+	}
+	if c.Version > protocol.ProtocolVersion {
+		return protocol.FromVersion(data, c.Version)
+	}
+	return data, nil
+}
+
+// mergeDeltas folds the chat.stream delta in next into tail, decoding and
+// re-encoding CBOR frames around the merge.
+func mergeDeltas(tail *Frame, next Frame) bool {
+	prev, data := tail.Data, next.Data
+	var err error
+	if tail.Binary {
+		if prev, err = protocol.DecodeBinary(prev); err != nil {
+			return false
+		}
+	}
+	if next.Binary {
+		if data, err = protocol.DecodeBinary(data); err != nil {
+			return false
+		}
+	}
+	merged, err := protocol.MergeStreamDeltas(prev, data)
+	if err != nil {
+		return false
+	}
+	if tail.Binary {
+		if merged, err = protocol.EncodeBinary(merged); err != nil {
+			return false
+		}
+	}
+	tail.Data = merged
+	return true
+}
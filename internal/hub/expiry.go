@@ -0,0 +1,44 @@
+package hub
+
+import (
+	"sync"
+	"time"
+
+	"github.com/openclaw/openclaw-relay/internal/protocol"
+)
+
+// expiry returns when a message received at received expires and a callback
+// that reports the expiry to its sender, at most once however many frames
+// carry it. Both are zero for messages without a TTL.
+func (h *Hub) expiry(session *Session, role, device string, env *protocol.Envelope, received time.Time) (time.Time, func()) {
+	deadline := env.Deadline(received)
+	if deadline.IsZero() {
+		return deadline, nil
+	}
+	var once sync.Once
+	return deadline, func() {
+		once.Do(func() { h.expire(session, role, device, env) })
+	}
+}
+
+// expire tells the sender of a message that it outlived its ttl_ms before it
+// could be delivered. The sender device's current connection is used, so the
+// notice still arrives if it reconnected meanwhile; agent messages replayed
+// from the mailbox no longer know their device and notify every agent.
+func (h *Hub) expire(session *Session, role, device string, env *protocol.Envelope) {
+	h.emit(Event{Kind: EventExpired, Token: session.Token, Role: role, Device: device, Type: env.Type, Code: protocol.ErrExpired})
+
+	conns := session.Conns(role)
+	if device != "" {
+		conns = nil
+		if conn := session.DeviceConn(role, device); conn != nil {
+			conns = []*Connection{conn}
+		}
+	}
+	for _, conn := range conns {
+		h.sendErrorPayload(conn, protocol.ErrorPayload{
+			Code:    protocol.ErrExpired,
+			Message: "Message expired before delivery",
+		}, env.ID)
+	}
+}
@@ -1,6 +1,7 @@
 package hub
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"sync"
@@ -17,25 +18,91 @@ const (
 	IdleSessionTimeout = 30 * time.Minute
 	// idleCleanupInterval is how often we scan for idle sessions.
 	idleCleanupInterval = 5 * time.Minute
+	// maxTokenTries bounds the search for a token this cluster node owns.
+	maxTokenTries = 1000
 )
 
+// ErrInvalidToken is returned for pairing tokens that do not exist.
+var ErrInvalidToken = errors.New("invalid token")
+
+// ErrUnsupportedVersion is returned when a client speaks no protocol version
+// the relay supports.
+var ErrUnsupportedVersion = errors.New("unsupported protocol version")
+
+// Config holds optional hub behaviour. The zero value is a usable default.
+type Config struct {
+	// AgentBalance selects how phone messages are spread across several
+	// agent connections (BalanceRoundRobin or BalanceLeastLoaded).
+	AgentBalance string
+	// OfflineQueue enables store-and-forward delivery to offline peers.
+	OfflineQueue OfflineQueue
+	// ReplayFrames and ReplayBytes bound the per-direction buffer of
+	// delivered frames kept for clients that resume after reconnecting.
+	ReplayFrames int
+	ReplayBytes  int64
+	// Observers receive an Event for everything notable the hub does.
+	Observers []Observer
+	// Interceptors is the chain every forwarded message passes through
+	// before delivery; nil uses DefaultInterceptors.
+	Interceptors []Interceptor
+	// MeterWireBytes charges the bandwidth quota with the bytes a frame
+	// takes on the socket, after compression, rather than its length.
+	MeterWireBytes bool
+	// MaxFileSize bounds a single file transfer (0 = DefaultMaxFileSize).
+	MaxFileSize int64
+	// StrictPayloads makes SchemaCheck refuse unencrypted payloads that
+	// do not match their message type's struct.
+	StrictPayloads bool
+	// Routes is the message routing policy; nil uses the built-in table.
+	Routes *protocol.RoutingTable
+	// RequestTimeout is how long requests with a result route wait for
+	// it when the route sets no timeout (0 = DefaultRequestTimeout).
+	RequestTimeout time.Duration
+	// Takeover is the default takeover policy for tokens without their
+	// own (TakeoverReplace if empty).
+	Takeover string
+	// ReconnectBackoff is the delay suggested to clients in system.reconnect
+	// when the relay drains (0 = DefaultReconnectBackoff).
+	ReconnectBackoff time.Duration
+	// OwnsToken, if set, reports whether this node owns a token in a
+	// cluster. New tokens are only issued if this node owns them.
+	OwnsToken func(token string) bool
+}
+
 // Hub manages all sessions and routes messages between paired connections.
 type Hub struct {
 	mu           sync.RWMutex
 	sessions     map[string]*Session
 	store        store.Store
+	config       Config
+	routes       *protocol.RoutingTable
 	quotaChecker *ratelimit.QuotaChecker
+	forward      Handler // interceptor chain ending in send
 	connCount    atomic.Int64
+	streams      atomic.Int64 // chat streams in flight
+	draining     atomic.Bool
+	drops        laneDrops
 	startTime    time.Time
 }
 
 func NewHub(s store.Store) *Hub {
+	return NewHubWithConfig(s, Config{})
+}
+
+// NewHubWithConfig creates a hub with the given configuration.
+func NewHubWithConfig(s store.Store, cfg Config) *Hub {
 	h := &Hub{
 		sessions:     make(map[string]*Session),
 		store:        s,
+		config:       cfg,
+		routes:       cfg.Routes,
 		quotaChecker: ratelimit.NewQuotaChecker(s),
 		startTime:    time.Now(),
 	}
+	if h.routes == nil {
+		h.routes = protocol.DefaultRoutingTable()
+	}
+	h.forward = h.chain()
 	go h.idleCleanupLoop()
 	return h
 }
@@ -44,6 +111,12 @@ func (h *Hub) ConnectionCount() int64 {
 	return h.connCount.Load()
 }
 
+// DroppedFrames returns how many outbound frames in a lane were dropped
+// across all connections because the lane was full.
+func (h *Hub) DroppedFrames(l Lane) int64 {
+	return h.drops[l].Load()
+}
+
 // StartTime returns when the hub was created.
 func (h *Hub) StartTime() time.Time {
 	return h.startTime
@@ -56,8 +129,18 @@ func (h *Hub) SessionCount() int {
 	return len(h.sessions)
 }
 
-func (h *Hub) Authenticate(conn *Connection, env *protocol.Envelope) (*Session, error) {
+func (h *Hub) Authenticate(conn *Connection, env *protocol.Envelope) (session *Session, err error) {
 	var auth protocol.AuthPayload
+	defer func() {
+		if err != nil {
+			h.emit(Event{Kind: EventAuthFailed, Token: auth.Token, Role: auth.Role, Device: auth.DeviceID, Err: err})
+		}
+	}()
+
+	if h.draining.Load() {
+		return nil, ErrDraining
+	}
+
 	if err := env.ParsePayload(&auth); err != nil {
 		return nil, err
 	}
@@ -67,19 +150,39 @@ func (h *Hub) Authenticate(conn *Connection, env *protocol.Envelope) (*Session,
 		return nil, err
 	}
 	if !exists {
-		return nil, fmt.Errorf("invalid token")
+		return nil, ErrInvalidToken
 	}
 
 	if auth.Role != protocol.RolePhone && auth.Role != protocol.RoleAgent {
 		return nil, fmt.Errorf("invalid role: %s", auth.Role)
 	}
+	if !protocol.ValidEncoding(auth.Encoding) {
+		return nil, fmt.Errorf("unsupported encoding: %s", auth.Encoding)
+	}
+	version, supported := protocol.NegotiateVersion(auth.Versions, env.V)
+	if !supported {
+		return nil, fmt.Errorf("%w: relay speaks %v", ErrUnsupportedVersion, protocol.SupportedVersions)
+	}
 
 	conn.Role = auth.Role
+	conn.out.totals = &h.drops
+	conn.Receipts = auth.Receipts
+	conn.Encoding = auth.Encoding
+	if conn.Encoding == "" {
+		conn.Encoding = protocol.EncodingJSON
+	}
+	conn.Version = version
+	conn.resumeSeq = auth.LastSeq
+	conn.DeviceID = auth.DeviceID
+	if conn.DeviceID == "" {
+		conn.DeviceID = protocol.DefaultDevice
+	}
 
 	if auth.Role == protocol.RolePhone {
 		conn.Limiter = ratelimit.NewPhoneLimiter()
 	} else {
 		conn.Limiter = ratelimit.NewAgentLimiter()
+		conn.AgentIDs = auth.Agents
 	}
 
 	h.mu.Lock()
@@ -90,110 +193,354 @@ func (h *Hub) Authenticate(conn *Connection, env *protocol.Envelope) (*Session,
 	}
 	h.mu.Unlock()
 
-	// Close existing connection of same role (use sync.Once safe close)
-	existing := session.SameRoleConn(auth.Role)
+	// The token's takeover policy decides what happens to an existing
+	// connection for the same role and device. The device takes what was
+	// queued for it at the same time, so nothing is queued in between.
+	wasPaired := session.IsPaired()
+	policy := h.TakeoverPolicy(auth.Token)
+	session.queueMu.Lock()
+	existing, err := session.claim(conn, policy)
+	if err == nil {
+		conn.resumeTo = session.replayTo(conn.Role).last()
+		h.takeQueued(session, conn)
+		if conn.resumeSeq < conn.resumeTo || len(conn.queued) > 0 {
+			conn.hold()
+		}
+	}
+	session.queueMu.Unlock()
+	if err != nil {
+		return nil, err
+	}
 	if existing != nil {
-		existing.CloseDone()
+		h.evict(existing, auth)
+		h.emit(connEvent(EventReplaced, session, existing))
 	}
-
-	session.SetConn(auth.Role, conn)
+	session.updatePresence(conn.Role, conn.DeviceID, func(p *protocol.Presence) {
+		*p = protocol.Presence{
+			Status:   protocol.StatusOnline,
+			State:    protocol.PresenceAvailable,
+			Client:   auth.Client,
+			Platform: auth.Platform,
+		}
+	})
 	h.connCount.Add(1)
 
-	log.Printf("auth: token=%s role=%s paired=%v", auth.Token[:16]+"...", auth.Role, session.IsPaired())
+	paired := session.IsPaired()
+	log.Printf("auth: token=%s role=%s device=%s paired=%v", auth.Token[:16]+"...", auth.Role, conn.DeviceID, paired)
+	h.emit(connEvent(EventAuth, session, conn))
+	if paired && !wasPaired {
+		h.emit(connEvent(EventPaired, session, conn))
+	}
 
 	return session, nil
 }
 
+// NotifyOnline tells the peers of a newly authenticated connection that it is
+// online, along with the presence of every device of its role.
+func (h *Hub) NotifyOnline(session *Session, conn *Connection) {
+	for _, peer := range session.PeerConns(conn.Role) {
+		h.sendStatus(session, peer, conn)
+	}
+}
+
 func (h *Hub) Disconnect(session *Session, conn *Connection) {
 	if session == nil || conn == nil {
 		return
 	}
-	session.ClearConn(conn.Role)
 	h.connCount.Add(-1)
+	h.interruptStreams(session, conn)
+	h.failRequests(session, conn)
+	h.emit(connEvent(EventDisconnect, session, conn))
+
+	// A connection that was replaced by a newer one for the same device
+	// leaves the session untouched.
+	wasPaired := session.IsPaired()
+	if !session.ClearConn(conn) {
+		log.Printf("disconnect: token=%s role=%s device=%s (replaced)", session.Token[:min(16, len(session.Token))]+"...", conn.Role, conn.DeviceID)
+		return
+	}
 
-	peer := session.PeerConn(conn.Role)
-	if peer != nil {
-		env, err := protocol.NewEnvelope(protocol.TypeStatus, protocol.StatusPayload{Peer: "offline"})
-		if err != nil {
-			log.Printf("error creating offline status: %v", err)
-			return
-		}
-		data, err := env.Marshal()
-		if err != nil {
-			log.Printf("error marshaling offline status: %v", err)
-			return
-		}
-		select {
-		case peer.Send <- data:
-		default:
-		}
+	session.updatePresence(conn.Role, conn.DeviceID, func(p *protocol.Presence) {
+		p.Status = protocol.StatusOffline
+	})
+	for _, peer := range session.PeerConns(conn.Role) {
+		h.sendStatus(session, peer, conn)
+	}
+	if wasPaired && !session.IsPaired() {
+		h.emit(connEvent(EventUnpaired, session, conn))
 	}
 
-	log.Printf("disconnect: token=%s role=%s", session.Token[:min(16, len(session.Token))]+"...", conn.Role)
+	log.Printf("disconnect: token=%s role=%s device=%s", session.Token[:min(16, len(session.Token))]+"...", conn.Role, conn.DeviceID)
 }
 
-func (h *Hub) ForwardMessage(session *Session, sender *Connection, raw []byte) error {
-	if len(raw) > ratelimit.MaxMessageSize {
-		return h.sendError(sender, protocol.ErrMessageTooLarge, "Message exceeds 5MB limit", 0)
+// ForwardMessage relays a message to the sender's peers. It first runs the
+// configured interceptors (by default the size, route, rate and quota checks)
+// and then delivers whatever they pass on: phone messages are tagged with the
+// originating device and routed to one agent of the pool; agent messages go to
+// every phone unless the envelope names a single device, which agents use to
+// answer the phone that asked.
+func (h *Hub) ForwardMessage(session *Session, sender *Connection, env *protocol.Envelope, raw []byte) error {
+	return h.Forward(&Message{Session: session, Sender: sender, Env: env, Raw: raw, Size: len(raw)})
+}
+
+// Forward is ForwardMessage for a message whose size on the wire, set in
+// m.Size, differs from its JSON form, such as one received as CBOR.
+func (h *Hub) Forward(m *Message) error {
+	session, sender := m.Session, m.Sender
+	m.hub = h
+	if m.Received.IsZero() {
+		m.Received = time.Now()
+	}
+	err := h.forward(m)
+	if sender.Role == protocol.RoleAgent {
+		h.trackStream(sender, m.Env, err == nil)
+	}
+	var rej *Rejection
+	switch {
+	case err == nil:
+		return nil
+	case errors.As(err, &rej):
+		return h.rejectPayload(session, sender, m.Env, rej.ErrorPayload)
+	case errors.Is(err, ErrDrop):
+		h.emit(messageEvent(EventDropped, session, sender, m.Env, len(m.Raw)))
+		return nil
+	default:
+		log.Printf("forward error for %s: %v", session.Token[:min(16, len(session.Token))]+"...", err)
+		return err
 	}
+}
 
-	if sender.Limiter != nil && !sender.Limiter.Allow() {
-		return h.sendError(sender, protocol.ErrRateLimited, "Rate limit exceeded", 1000)
+// send is the last link of the forwarding chain.
+func (h *Hub) send(m *Message) error {
+	session, sender, env, raw, route := m.Session, m.Sender, m.Env, m.Raw, m.Route
+	if route.Type == "" {
+		// The chain was configured without RouteCheck.
+		var err error
+		if route, err = h.Route(sender.Role, env.Type); err != nil {
+			return Reject(protocol.ErrInvalidMessage, err.Error(), 0)
+		}
 	}
 
-	code, err := h.quotaChecker.Check(session.Token)
-	if err != nil {
-		log.Printf("quota check error for %s: %v", session.Token, err)
+	if sender.Role == protocol.RolePhone {
+		tagged, err := protocol.SetField(raw, "device", sender.DeviceID)
+		if err != nil {
+			return Reject(protocol.ErrInvalidMessage, "Invalid JSON message", 0)
+		}
+		raw = tagged
 	}
-	if code != "" {
-		return h.sendError(sender, code, "Bandwidth quota exceeded", 60000)
+
+	expires, onExpired := h.expiry(session, sender.Role, sender.DeviceID, env, m.Received)
+	if !expires.IsZero() && !time.Now().Before(expires) {
+		onExpired()
+		return nil
 	}
 
-	peer := session.PeerConn(sender.Role)
-	if peer == nil {
-		return h.sendError(sender, protocol.ErrPeerOffline, "Peer is not connected", 0)
+	h.completeRequest(session, sender, env)
+
+	// Ephemeral messages are best effort: never queued, sequenced or
+	// accounted, and silently dropped if no peer can take them. As they
+	// escape the quota, they are kept small.
+	if route.Ephemeral {
+		if m.Size > ratelimit.MaxEphemeralSize {
+			return Reject(protocol.ErrMessageTooLarge, "Ephemeral message exceeds 4KB limit", 0)
+		}
+		for _, peer := range h.recipients(session, sender, env) {
+			peer.Enqueue(Frame{Data: raw, Expires: expires})
+		}
+		return nil
+	}
+	peers, raw, err := h.dispatch(session, sender, env, raw, expires)
+	if err != nil {
+		return err
+	}
+	if len(peers) == 0 {
+		h.emit(messageEvent(EventQueued, session, sender, env, len(raw)))
+		return nil
 	}
 
-	msgSize := int64(len(raw))
+	frame := Frame{Data: raw, Expires: expires, OnExpired: onExpired}
+	if sender.Receipts && env.ID != "" {
+		var once sync.Once
+		frame.OnWritten = func() {
+			once.Do(func() { h.sendReceipt(sender, env.ID) })
+		}
+	}
 
-	select {
-	case peer.Send <- raw:
-		// Record quota and stats only after successful send
-		if err := h.quotaChecker.Record(session.Token, msgSize); err != nil {
+	// A request is tracked before any responder can see it
+	req := h.trackRequest(session, sender, peers[0], env, route)
+	delivered := 0
+	var responder *Connection
+	var charged Frame
+	for _, peer := range peers {
+		// Encode for the peer up front so it is metered by what it receives
+		peerFrame := peer.Encode(frame)
+		if !h.deliver(peer, sender, env, peerFrame) {
+			continue
+		}
+		if responder == nil {
+			responder, charged = peer, peerFrame
+			if req != nil && peer != peers[0] {
+				session.setResponder(req, peer)
+			}
+		}
+		sender.BytesSent.Add(int64(len(peerFrame.Data)))
+		peer.BytesRecv.Add(int64(len(peerFrame.Data)))
+		delivered++
+	}
+	// Record quota only after successful send, once however many devices
+	// received the message, so its wire size is computed once
+	if route.Metered && delivered > 0 {
+		if err := h.quotaChecker.Record(session.Token, h.frameSize(responder, charged)); err != nil {
 			log.Printf("quota record error: %v", err)
 		}
-		sender.BytesSent.Add(msgSize)
-		peer.BytesRecv.Add(msgSize)
+	}
+	if delivered == 0 {
+		h.untrackRequest(session, req)
+		return Reject(protocol.ErrPeerOffline, "Peer send buffer full", 1000)
+	}
+	ev := messageEvent(EventForward, session, sender, env, len(raw))
+	ev.Peers = delivered
+	h.emit(ev)
+	return nil
+}
+
+// recipients returns the connections a message goes to: one agent of the pool
+// for phone messages, and for agent messages the phone device the envelope
+// names or else every phone.
+func (h *Hub) recipients(session *Session, sender *Connection, env *protocol.Envelope) []*Connection {
+	if sender.Role == protocol.RolePhone {
+		if agent := h.routeToAgent(session, env); agent != nil {
+			return []*Connection{agent}
+		}
 		return nil
-	default:
-		return h.sendError(sender, protocol.ErrPeerOffline, "Peer send buffer full", 1000)
 	}
+	if env.Device != "" {
+		if peer := session.DeviceConn(protocol.RolePhone, env.Device); peer != nil {
+			return []*Connection{peer}
+		}
+		return nil
+	}
+	return session.PeerConns(sender.Role)
+}
+
+// dispatch picks the recipients of a message and stamps it with their next
+// relay sequence number, or queues it for the peer role if there are none, in
+// which case it returns no peers. It holds queueMu for reading, so a device
+// authenticating meanwhile either finds the message in its mailbox or is
+// among the recipients of a frame sequenced after everything it took.
+func (h *Hub) dispatch(session *Session, sender *Connection, env *protocol.Envelope, raw []byte, expires time.Time) ([]*Connection, []byte, error) {
+	session.queueMu.RLock()
+	defer session.queueMu.RUnlock()
+	peers := h.recipients(session, sender, env)
+	if len(peers) == 0 {
+		if !h.enqueueForPeer(session, peerRole(sender.Role), env, raw) {
+			return nil, nil, Reject(protocol.ErrPeerOffline, "Peer is not connected", 0)
+		}
+		return nil, raw, nil
+	}
+	data, err := h.sequence(session, peers, raw, expires)
+	if err != nil {
+		return nil, nil, Reject(protocol.ErrInvalidMessage, "Invalid JSON message", 0)
+	}
+	return peers, data, nil
+}
+
+// Routes returns the routing table the hub was configured with.
+func (h *Hub) Routes() *protocol.RoutingTable {
+	return h.routes
+}
+
+// Route resolves the routing policy for a message type sent by role. It
+// returns an error describing why the message must be rejected.
+func (h *Hub) Route(role, msgType string) (protocol.Route, error) {
+	route, ok := h.routes.Lookup(msgType)
+	if !ok {
+		if h.routes.Unknown != protocol.UnknownPass {
+			return route, fmt.Errorf("unknown message type: %s", msgType)
+		}
+		return protocol.Route{
+			Type:    msgType,
+			From:    []string{protocol.RolePhone, protocol.RoleAgent},
+			Target:  protocol.TargetPeer,
+			Metered: true,
+		}, nil
+	}
+	if !route.Allows(role) {
+		return route, fmt.Errorf("%s cannot send %s messages", role, msgType)
+	}
+	return route, nil
+}
+
+// rejectPayload refuses a message from sender with a chat.error and reports it to
+// observers.
+func (h *Hub) rejectPayload(session *Session, sender *Connection, env *protocol.Envelope, payload protocol.ErrorPayload) error {
+	ev := messageEvent(EventRejected, session, sender, env, 0)
+	switch payload.Code {
+	case protocol.ErrDailyQuotaExceeded, protocol.ErrMonthlyQuotaExceeded, protocol.ErrFileExceedsQuota:
+		ev.Kind = EventQuotaExceeded
+	}
+	ev.Code = payload.Code
+	h.emit(ev)
+	return h.sendErrorPayload(sender, payload, "")
+}
+
+// frameSize is the size a frame delivered to conn is metered at.
+func (h *Hub) frameSize(conn *Connection, f Frame) int64 {
+	if h.config.MeterWireBytes {
+		return conn.WireSize(f)
+	}
+	return int64(len(f.Data))
 }
 
 func (h *Hub) sendError(conn *Connection, code, message string, retryMs int64) error {
-	env, err := protocol.NewEnvelope(protocol.TypeChatError, protocol.ErrorPayload{
+	return h.sendErrorPayload(conn, protocol.ErrorPayload{
 		Code:         code,
 		Message:      message,
 		RetryAfterMs: retryMs,
-	})
+	}, "")
+}
+
+// sendErrorPayload queues a chat.error, optionally as the reply to a request.
+func (h *Hub) sendErrorPayload(conn *Connection, payload protocol.ErrorPayload, replyTo string) error {
+	env, err := protocol.NewEnvelope(protocol.TypeChatError, payload)
 	if err != nil {
 		log.Printf("error creating error envelope: %v", err)
 		return err
 	}
+	env.ReplyTo = replyTo
 	data, err := env.Marshal()
 	if err != nil {
 		log.Printf("error marshaling error envelope: %v", err)
 		return err
 	}
-	select {
-	case conn.Send <- data:
-	default:
-	}
+	conn.Enqueue(Frame{Data: data, Lane: LaneControl})
 	return nil
 }
 
+// sendReceipt tells a sender that its message with the given ID reached the
+// peer's socket.
+func (h *Hub) sendReceipt(conn *Connection, id string) {
+	env, err := protocol.NewEnvelope(protocol.TypeDelivered, protocol.DeliveredPayload{ID: id})
+	if err != nil {
+		log.Printf("error creating receipt envelope: %v", err)
+		return
+	}
+	data, err := env.Marshal()
+	if err != nil {
+		log.Printf("error marshaling receipt envelope: %v", err)
+		return
+	}
+	conn.Enqueue(Frame{Data: data, Lane: LaneControl})
+}
+
 func (h *Hub) CreateToken() (string, error) {
 	token := GenerateToken()
+	for tries := 1; h.config.OwnsToken != nil && !h.config.OwnsToken(token); tries++ {
+		if tries == maxTokenTries {
+			return "", fmt.Errorf("no owned token after %d tries", tries)
+		}
+		token = GenerateToken()
+	}
 	if err := h.store.CreateToken(token); err != nil {
 		return "", err
 	}
@@ -204,15 +551,11 @@ func (h *Hub) CreateToken() (string, error) {
 func (h *Hub) DeleteToken(token string) error {
 	h.mu.Lock()
 	if session, ok := h.sessions[token]; ok {
-		session.mu.RLock()
-		phone := session.PhoneConn
-		agent := session.AgentConn
-		session.mu.RUnlock()
-		if phone != nil {
-			phone.CloseDone()
+		for _, conn := range session.Conns(protocol.RolePhone) {
+			conn.CloseDone()
 		}
-		if agent != nil {
-			agent.CloseDone()
+		for _, conn := range session.Conns(protocol.RoleAgent) {
+			conn.CloseDone()
 		}
 		delete(h.sessions, token)
 	}
@@ -227,7 +570,7 @@ func (h *Hub) GetTokenStatus(token string) (phoneOnline, agentOnline bool) {
 	if session, ok := h.sessions[token]; ok {
 		session.mu.RLock()
 		defer session.mu.RUnlock()
-		return session.PhoneConn != nil, session.AgentConn != nil
+		return len(session.Phones) > 0, len(session.Agents) > 0
 	}
 	return false, false
 }
@@ -239,28 +582,27 @@ func (h *Hub) idleCleanupLoop() {
 
 	for range ticker.C {
 		h.cleanIdleSessions()
+		h.purgeMailbox()
 	}
 }
 
 func (h *Hub) cleanIdleSessions() {
 	h.mu.Lock()
-	defer h.mu.Unlock()
-
-	var removed int
+	var removed []string
 	for token, session := range h.sessions {
 		if session.IsIdle(IdleSessionTimeout) {
 			delete(h.sessions, token)
-			removed++
+			removed = append(removed, token)
 		}
 	}
-	if removed > 0 {
-		log.Printf("cleaned %d idle sessions, %d remaining", removed, len(h.sessions))
-	}
-}
+	remaining := len(h.sessions)
+	h.mu.Unlock()
 
-func min(a, b int) int {
-	if a < b {
-		return a
+	// Observers may call back into the hub, so they are told after unlocking
+	for _, token := range removed {
+		h.emit(Event{Kind: EventIdleCleanup, Token: token})
+	}
+	if len(removed) > 0 {
+		log.Printf("cleaned %d idle sessions, %d remaining", len(removed), remaining)
 	}
-	return b
 }
@@ -1,13 +1,25 @@
 package hub
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/gorilla/websocket"
 	"github.com/openclaw/openclaw-relay/internal/protocol"
+	"github.com/openclaw/openclaw-relay/internal/ratelimit"
 	"github.com/openclaw/openclaw-relay/internal/store"
+	"golang.org/x/time/rate"
 )
 
 // mockStore implements store.Store for testing.
@@ -15,12 +27,14 @@ type mockStore struct {
 	mu        sync.Mutex
 	tokens    map[string]bool
 	bandwidth map[string]int64
+	takeover  map[string]string
 }
 
 func newMockStore() *mockStore {
 	return &mockStore{
 		tokens:    make(map[string]bool),
 		bandwidth: make(map[string]int64),
+		takeover:  make(map[string]string),
 	}
 }
 
@@ -70,6 +84,19 @@ func (s *mockStore) GetMonthlyUsage(token string) (int64, error) {
 func (s *mockStore) ResetDailyUsage() error { return nil }
 func (s *mockStore) Close() error           { return nil }
 
+func (s *mockStore) SetTakeoverPolicy(token, policy string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.takeover[token] = policy
+	return nil
+}
+
+func (s *mockStore) TakeoverPolicy(token string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.takeover[token], nil
+}
+
 func TestNewHub(t *testing.T) {
 	store := newMockStore()
 	h := NewHub(store)
@@ -247,6 +274,31 @@ func TestIdleSessionCleanup(t *testing.T) {
 	}
 }
 
+func TestIdleCleanupObserverCanCallHub(t *testing.T) {
+	store := newMockStore()
+	var h *Hub
+	remaining := -1
+	// The observer calls back into the hub, which must not deadlock
+	h = NewHubWithConfig(store, Config{Observers: []Observer{ObserverFunc(func(e Event) {
+		if e.Kind == EventIdleCleanup {
+			remaining = h.SessionCount()
+		}
+	})}})
+
+	token, _ := h.CreateToken()
+	h.mu.Lock()
+	session := &Session{Token: token}
+	session.LastActive.Store(time.Now().Add(-31 * time.Minute))
+	h.sessions[token] = session
+	h.mu.Unlock()
+
+	h.cleanIdleSessions()
+
+	if remaining != 0 {
+		t.Fatalf("observer saw %d sessions, want 0", remaining)
+	}
+}
+
 func TestConcurrentAuth(t *testing.T) {
 	store := newMockStore()
 	h := NewHub(store)
@@ -270,3 +322,1789 @@ func TestConcurrentAuth(t *testing.T) {
 	}
 	wg.Wait()
 }
+
+// authConn authenticates a new connection for role and device on token.
+func authConn(t *testing.T, h *Hub, token, role, device string) (*Session, *Connection) {
+	t.Helper()
+	conn := NewConnection(nil, "", nil)
+	authPayload, _ := json.Marshal(protocol.AuthPayload{Token: token, Role: role, DeviceID: device})
+	env := &protocol.Envelope{Type: protocol.TypeAuth, Payload: authPayload}
+	session, err := h.Authenticate(conn, env)
+	if err != nil {
+		t.Fatalf("Authenticate failed: %v", err)
+	}
+	return session, conn
+}
+
+// recvEnvelope reads the next queued frame from conn without blocking.
+func recvEnvelope(t *testing.T, conn *Connection) *protocol.Envelope {
+	t.Helper()
+	frame, ok := conn.Next()
+	if !ok {
+		t.Fatal("expected a queued frame")
+	}
+	var env protocol.Envelope
+	if err := json.Unmarshal(frame.Data, &env); err != nil {
+		t.Fatalf("invalid frame: %v", err)
+	}
+	return &env
+}
+
+func TestMultiDeviceFanOut(t *testing.T) {
+	store := newMockStore()
+	h := NewHub(store)
+	token, _ := h.CreateToken()
+
+	session, phone := authConn(t, h, token, "phone", "phone")
+	_, tablet := authConn(t, h, token, "phone", "tablet")
+	_, agent := authConn(t, h, token, "agent", "")
+
+	if isClosed(phone.Done) {
+		t.Fatal("second device must not evict the first")
+	}
+
+	env, _ := protocol.NewEnvelope(protocol.TypeChatStream, protocol.ChatStreamPayload{Delta: "hi", Seq: 1})
+	raw, _ := env.Marshal()
+	if err := h.ForwardMessage(session, agent, env, raw); err != nil {
+		t.Fatalf("ForwardMessage failed: %v", err)
+	}
+	for _, c := range []*Connection{phone, tablet} {
+		frame, _ := c.Next()
+		if usage, _ := store.GetDailyUsage(token); usage != int64(len(frame.Data)) {
+			t.Fatalf("fan-out must be charged once: usage %d for a %d byte frame", usage, len(frame.Data))
+		}
+		if !strings.Contains(string(frame.Data), protocol.TypeChatStream) {
+			t.Fatalf("expected chat.stream on %s, got %s", c.DeviceID, frame.Data)
+		}
+	}
+
+	// Targeted reply reaches only the named device
+	env.Device = "tablet"
+	raw, _ = env.Marshal()
+	h.ForwardMessage(session, agent, env, raw)
+	recvEnvelope(t, tablet)
+	if phone.Pending() != 0 {
+		t.Fatal("targeted reply should not reach other devices")
+	}
+}
+
+func TestPhoneMessagesTaggedWithDevice(t *testing.T) {
+	store := newMockStore()
+	h := NewHub(store)
+	token, _ := h.CreateToken()
+
+	_, agent := authConn(t, h, token, "agent", "")
+	session, tablet := authConn(t, h, token, "phone", "tablet")
+
+	// A phone cannot spoof another device
+	env, _ := protocol.NewEnvelope(protocol.TypeChatSend, protocol.ChatSendPayload{Text: "hello"})
+	env.Device = "phone"
+	raw, _ := env.Marshal()
+	h.ForwardMessage(session, tablet, env, raw)
+
+	got := recvEnvelope(t, agent)
+	if got.Device != "tablet" {
+		t.Fatalf("expected device tag 'tablet', got %q", got.Device)
+	}
+}
+
+func TestDeviceStatusPresence(t *testing.T) {
+	store := newMockStore()
+	h := NewHub(store)
+	token, _ := h.CreateToken()
+
+	_, agent := authConn(t, h, token, "agent", "")
+	session, phone := authConn(t, h, token, "phone", "phone")
+	h.NotifyOnline(session, phone)
+	_, tablet := authConn(t, h, token, "phone", "tablet")
+	h.NotifyOnline(session, tablet)
+	recvEnvelope(t, agent)
+	recvEnvelope(t, agent)
+
+	h.Disconnect(session, phone)
+
+	env := recvEnvelope(t, agent)
+	var status protocol.StatusPayload
+	env.ParsePayload(&status)
+	if status.Peer != protocol.StatusOnline {
+		t.Fatalf("peer should stay online while a device remains, got %s", status.Peer)
+	}
+	if status.Device != "phone" || len(status.Devices) != 2 {
+		t.Fatalf("unexpected presence: %+v", status)
+	}
+	for _, p := range status.Devices {
+		want := protocol.StatusOnline
+		if p.Device == "phone" {
+			want = protocol.StatusOffline
+		}
+		if p.Status != want {
+			t.Fatalf("device %s: expected %s, got %s", p.Device, want, p.Status)
+		}
+	}
+}
+
+func isClosed(ch chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
+
+func TestAgentPoolRoutesByAgentID(t *testing.T) {
+	store := newMockStore()
+	h := NewHub(store)
+	token, _ := h.CreateToken()
+
+	hostA := NewConnection(nil, "", nil)
+	authPayload, _ := json.Marshal(protocol.AuthPayload{Token: token, Role: "agent", DeviceID: "host-a", Agents: []string{"main"}})
+	h.Authenticate(hostA, &protocol.Envelope{Type: protocol.TypeAuth, Payload: authPayload})
+	hostB := NewConnection(nil, "", nil)
+	authPayload, _ = json.Marshal(protocol.AuthPayload{Token: token, Role: "agent", DeviceID: "host-b", Agents: []string{"hamon"}})
+	session, _ := h.Authenticate(hostB, &protocol.Envelope{Type: protocol.TypeAuth, Payload: authPayload})
+	_, phone := authConn(t, h, token, "phone", "")
+
+	if isClosed(hostA.Done) {
+		t.Fatal("second agent must not evict the first")
+	}
+
+	for i := 0; i < 3; i++ {
+		env, _ := protocol.NewEnvelope(protocol.TypeChatSend, protocol.ChatSendPayload{Text: "hi", AgentID: "hamon"})
+		raw, _ := env.Marshal()
+		h.ForwardMessage(session, phone, env, raw)
+	}
+	if hostB.Pending() != 3 || hostA.Pending() != 0 {
+		t.Fatalf("expected all messages on host-b, got a=%d b=%d", hostA.Pending(), hostB.Pending())
+	}
+}
+
+func TestAgentPoolRoundRobin(t *testing.T) {
+	store := newMockStore()
+	h := NewHub(store)
+	token, _ := h.CreateToken()
+
+	_, hostA := authConn(t, h, token, "agent", "host-a")
+	_, hostB := authConn(t, h, token, "agent", "host-b")
+	session, phone := authConn(t, h, token, "phone", "")
+
+	for i := 0; i < 4; i++ {
+		env, _ := protocol.NewEnvelope(protocol.TypeChatSend, protocol.ChatSendPayload{Text: "hi"})
+		raw, _ := env.Marshal()
+		h.ForwardMessage(session, phone, env, raw)
+	}
+	if hostA.Pending() != 2 || hostB.Pending() != 2 {
+		t.Fatalf("expected even spread, got a=%d b=%d", hostA.Pending(), hostB.Pending())
+	}
+}
+
+func TestAgentPoolLeastLoaded(t *testing.T) {
+	store := newMockStore()
+	h := NewHubWithConfig(store, Config{AgentBalance: BalanceLeastLoaded})
+	token, _ := h.CreateToken()
+
+	_, hostA := authConn(t, h, token, "agent", "host-a")
+	_, hostB := authConn(t, h, token, "agent", "host-b")
+	session, phone := authConn(t, h, token, "phone", "")
+
+	hostA.Enqueue(Frame{Data: []byte("{}")})
+	hostA.Enqueue(Frame{Data: []byte("{}")})
+
+	env, _ := protocol.NewEnvelope(protocol.TypeChatSend, protocol.ChatSendPayload{Text: "hi"})
+	raw, _ := env.Marshal()
+	h.ForwardMessage(session, phone, env, raw)
+	if hostB.Pending() != 1 {
+		t.Fatal("expected the idle agent to receive the message")
+	}
+}
+
+// mockMailbox implements store.Mailbox in memory.
+type mockMailbox struct {
+	mu     sync.Mutex
+	nextID int64
+	msgs   map[string][]store.QueuedMessage // keyed by token/role
+}
+
+func newMockMailbox() *mockMailbox {
+	return &mockMailbox{msgs: make(map[string][]store.QueuedMessage)}
+}
+
+func (m *mockMailbox) Enqueue(token, role, device string, data []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.nextID++
+	key := token + "/" + role
+	m.msgs[key] = append(m.msgs[key], store.QueuedMessage{ID: m.nextID, Device: device, Data: data, CreatedAt: time.Now()})
+	return nil
+}
+
+func (m *mockMailbox) Pending(token, role, device string, since time.Time) ([]store.QueuedMessage, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var out []store.QueuedMessage
+	for _, msg := range m.msgs[token+"/"+role] {
+		if (msg.Device == "" || msg.Device == device) && !msg.CreatedAt.Before(since) {
+			out = append(out, msg)
+		}
+	}
+	return out, nil
+}
+
+func (m *mockMailbox) Remove(id int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for key, msgs := range m.msgs {
+		for i, msg := range msgs {
+			if msg.ID == id {
+				m.msgs[key] = append(msgs[:i], msgs[i+1:]...)
+				return nil
+			}
+		}
+	}
+	return nil
+}
+
+func (m *mockMailbox) MailboxUsage(token, role string) (int, int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var bytes int64
+	for _, msg := range m.msgs[token+"/"+role] {
+		bytes += int64(len(msg.Data))
+	}
+	return len(m.msgs[token+"/"+role]), bytes, nil
+}
+
+func (m *mockMailbox) PurgeExpired(before time.Time) (int64, error) { return 0, nil }
+
+func TestOfflineQueueReplay(t *testing.T) {
+	store := newMockStore()
+	mailbox := newMockMailbox()
+	h := NewHubWithConfig(store, Config{OfflineQueue: OfflineQueue{Mailbox: mailbox, MaxMessages: 2}})
+	token, _ := h.CreateToken()
+
+	session, phone := authConn(t, h, token, "phone", "")
+	for _, text := range []string{"one", "two", "three"} {
+		env, _ := protocol.NewEnvelope(protocol.TypeChatSend, protocol.ChatSendPayload{Text: text})
+		raw, _ := env.Marshal()
+		h.ForwardMessage(session, phone, env, raw)
+	}
+
+	// Third message exceeds the mailbox limit and is reported offline
+	if got := recvEnvelope(t, phone); got.Type != protocol.TypeChatError {
+		t.Fatalf("expected chat.error for full mailbox, got %s", got.Type)
+	}
+	if usage, _ := store.GetDailyUsage(token); usage != 0 {
+		t.Fatalf("queued messages must not count against quota yet, got %d", usage)
+	}
+
+	_, agent := authConn(t, h, token, "agent", "")
+	h.DeliverQueued(session, agent)
+
+	for _, want := range []string{"one", "two"} {
+		env := recvEnvelope(t, agent)
+		var p protocol.ChatSendPayload
+		env.ParsePayload(&p)
+		if p.Text != want {
+			t.Fatalf("expected %q, got %q", want, p.Text)
+		}
+	}
+	if usage, _ := store.GetDailyUsage(token); usage == 0 {
+		t.Fatal("delivered messages should count against quota")
+	}
+	if count, _, _ := mailbox.MailboxUsage(token, "agent"); count != 0 {
+		t.Fatalf("expected empty mailbox after replay, got %d", count)
+	}
+}
+
+func TestOfflineQueueTargetedReply(t *testing.T) {
+	store := newMockStore()
+	mailbox := newMockMailbox()
+	h := NewHubWithConfig(store, Config{OfflineQueue: OfflineQueue{Mailbox: mailbox}})
+	token, _ := h.CreateToken()
+
+	session, agent := authConn(t, h, token, "agent", "")
+	mailbox.Enqueue(token, "phone", "", []byte("{not json"))
+	env, _ := protocol.NewEnvelope(protocol.TypeChatHistoryResult, map[string]string{"for": "tablet"})
+	env.Device = "tablet"
+	raw, _ := env.Marshal()
+	if err := h.ForwardMessage(session, agent, env, raw); err != nil {
+		t.Fatalf("ForwardMessage failed: %v", err)
+	}
+
+	_, phone := authConn(t, h, token, "phone", "phone")
+	h.DeliverQueued(session, phone)
+	if phone.Pending() != 0 {
+		t.Fatal("a reply for the tablet must not reach another device")
+	}
+	if count, _, _ := mailbox.MailboxUsage(token, "phone"); count != 1 {
+		t.Fatalf("expected the corrupt entry dropped and the reply kept, got %d entries", count)
+	}
+
+	_, tablet := authConn(t, h, token, "phone", "tablet")
+	h.DeliverQueued(session, tablet)
+	if got := recvEnvelope(t, tablet); got.Type != protocol.TypeChatHistoryResult {
+		t.Fatalf("expected the queued reply on the tablet, got %s", got.Type)
+	}
+}
+
+func TestOfflineQueueFansOutToDevices(t *testing.T) {
+	store := newMockStore()
+	mailbox := newMockMailbox()
+	h := NewHubWithConfig(store, Config{OfflineQueue: OfflineQueue{Mailbox: mailbox}})
+	token, _ := h.CreateToken()
+
+	session, agent := authConn(t, h, token, "agent", "")
+	_, phone := authConn(t, h, token, "phone", "phone")
+	_, tablet := authConn(t, h, token, "phone", "tablet")
+	h.Disconnect(session, phone)
+	h.Disconnect(session, tablet)
+
+	env, _ := protocol.NewEnvelope(protocol.TypeChatToolStatus, map[string]string{"tool": "search"})
+	raw, _ := env.Marshal()
+	if err := h.ForwardMessage(session, agent, env, raw); err != nil {
+		t.Fatalf("ForwardMessage failed: %v", err)
+	}
+
+	for _, device := range []string{"tablet", "phone"} {
+		_, conn := authConn(t, h, token, "phone", device)
+		h.DeliverQueued(session, conn)
+		if got := recvEnvelope(t, conn); got.Type != protocol.TypeChatToolStatus {
+			t.Fatalf("%s: expected the queued message, got %s", device, got.Type)
+		}
+	}
+	if count, _, _ := mailbox.MailboxUsage(token, "phone"); count != 0 {
+		t.Fatalf("expected empty mailbox after both devices replayed, got %d", count)
+	}
+}
+
+func TestOfflineQueueClaimedOnce(t *testing.T) {
+	store := newMockStore()
+	mailbox := newMockMailbox()
+	h := NewHubWithConfig(store, Config{OfflineQueue: OfflineQueue{Mailbox: mailbox}})
+	token, _ := h.CreateToken()
+
+	// Queued before any phone was seen: one copy for whichever device comes first
+	session, agent := authConn(t, h, token, "agent", "")
+	env, _ := protocol.NewEnvelope(protocol.TypeChatToolStatus, map[string]string{"tool": "search"})
+	raw, _ := env.Marshal()
+	h.ForwardMessage(session, agent, env, raw)
+
+	conns := make([]*Connection, 8)
+	var wg sync.WaitGroup
+	for i := range conns {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, conns[i] = authConn(t, h, token, "phone", fmt.Sprintf("device-%d", i))
+			h.DeliverQueued(session, conns[i])
+		}(i)
+	}
+	wg.Wait()
+
+	received := 0
+	for _, conn := range conns {
+		for conn.Pending() > 0 {
+			if recvEnvelope(t, conn).Type == protocol.TypeChatToolStatus {
+				received++
+			}
+		}
+	}
+	if received != 1 {
+		t.Fatalf("expected the entry delivered once, got %d", received)
+	}
+}
+
+func TestOfflineQueueAheadOfLiveFrames(t *testing.T) {
+	store := newMockStore()
+	mailbox := newMockMailbox()
+	h := NewHubWithConfig(store, Config{OfflineQueue: OfflineQueue{Mailbox: mailbox}})
+	token, _ := h.CreateToken()
+
+	session, agent := authConn(t, h, token, "agent", "")
+	send := func(text string) {
+		env, _ := protocol.NewEnvelope(protocol.TypeChatDone, protocol.ChatDonePayload{FullText: text})
+		raw, _ := env.Marshal()
+		if err := h.ForwardMessage(session, agent, env, raw); err != nil {
+			t.Fatalf("ForwardMessage failed: %v", err)
+		}
+	}
+	send("old")
+
+	// Forwarded after the phone registered but before its backlog went out
+	_, phone := authConn(t, h, token, "phone", "")
+	send("new")
+	if _, ok := phone.Next(); ok {
+		t.Fatal("live frame sent ahead of the backlog")
+	}
+	h.DeliverQueued(session, phone)
+
+	var last uint64
+	for _, want := range []string{"old", "new"} {
+		env := recvEnvelope(t, phone)
+		var p protocol.ChatDonePayload
+		env.ParsePayload(&p)
+		if p.FullText != want || env.RSeq <= last {
+			t.Fatalf("expected %q after rseq %d, got %q rseq %d", want, last, p.FullText, env.RSeq)
+		}
+		last = env.RSeq
+	}
+}
+
+func TestResumeResendsGap(t *testing.T) {
+	store := newMockStore()
+	h := NewHub(store)
+	token, _ := h.CreateToken()
+
+	_, agent := authConn(t, h, token, "agent", "")
+	session, phone := authConn(t, h, token, "phone", "")
+	for i := 1; i <= 3; i++ {
+		env, _ := protocol.NewEnvelope(protocol.TypeChatStream, protocol.ChatStreamPayload{Delta: "x", Seq: i})
+		raw, _ := env.Marshal()
+		h.ForwardMessage(session, agent, env, raw)
+	}
+	for i := uint64(1); i <= 3; i++ {
+		if got := recvEnvelope(t, phone); got.RSeq != i {
+			t.Fatalf("expected rseq %d, got %d", i, got.RSeq)
+		}
+	}
+
+	// Phone processed only the first frame before its socket died
+	phone2 := NewConnection(nil, "", nil)
+	authPayload, _ := json.Marshal(protocol.AuthPayload{Token: token, Role: "phone", LastSeq: 1})
+	h.Authenticate(phone2, &protocol.Envelope{Type: protocol.TypeAuth, Payload: authPayload})
+
+	ok := h.AuthOk(session, phone2)
+	if !ok.Resumed || ok.LastSeq != 3 {
+		t.Fatalf("expected complete resume up to 3, got %+v", ok)
+	}
+	h.Resume(session, phone2)
+	for i := uint64(2); i <= 3; i++ {
+		if got := recvEnvelope(t, phone2); got.RSeq != i {
+			t.Fatalf("expected resent rseq %d, got %d", i, got.RSeq)
+		}
+	}
+}
+
+func TestResumeAheadOfLiveFrames(t *testing.T) {
+	store := newMockStore()
+	h := NewHub(store)
+	token, _ := h.CreateToken()
+
+	_, agent := authConn(t, h, token, "agent", "")
+	session, phone := authConn(t, h, token, "phone", "")
+	send := func(seq int) {
+		env, _ := protocol.NewEnvelope(protocol.TypeChatStream, protocol.ChatStreamPayload{Delta: "x", Seq: seq})
+		raw, _ := env.Marshal()
+		h.ForwardMessage(session, agent, env, raw)
+	}
+	for seq := 1; seq <= 3; seq++ {
+		send(seq)
+	}
+	for phone.Pending() > 0 {
+		phone.Next()
+	}
+
+	// Frame 4 is forwarded after the phone registered, before the gap is resent
+	phone2 := NewConnection(nil, "", nil)
+	authPayload, _ := json.Marshal(protocol.AuthPayload{Token: token, Role: "phone", LastSeq: 1})
+	h.Authenticate(phone2, &protocol.Envelope{Type: protocol.TypeAuth, Payload: authPayload})
+	send(4)
+	if _, ok := phone2.Next(); ok {
+		t.Fatal("live frame sent ahead of the resent gap")
+	}
+	h.Resume(session, phone2)
+
+	var seqs []uint64
+	for phone2.Pending() > 0 {
+		seqs = append(seqs, recvEnvelope(t, phone2).RSeq)
+	}
+	if fmt.Sprint(seqs) != "[2 3 4]" {
+		t.Fatalf("expected rseq 2 to 4 once each, got %v", seqs)
+	}
+}
+
+func TestAckReleasesReplayBuffer(t *testing.T) {
+	store := newMockStore()
+	h := NewHubWithConfig(store, Config{ReplayFrames: 2})
+	token, _ := h.CreateToken()
+
+	_, agent := authConn(t, h, token, "agent", "")
+	session, phone := authConn(t, h, token, "phone", "")
+	for i := 1; i <= 3; i++ {
+		env, _ := protocol.NewEnvelope(protocol.TypeChatStream, protocol.ChatStreamPayload{Delta: "x", Seq: i})
+		raw, _ := env.Marshal()
+		h.ForwardMessage(session, agent, env, raw)
+	}
+
+	// Frame 1 was evicted by the 2-frame limit, so resuming from 0..1 is lossy
+	if _, complete := session.replayTo("phone").since(phone.DeviceID, 0); complete {
+		t.Fatal("resume from 0 should be incomplete after eviction")
+	}
+	if _, complete := session.replayTo("phone").since(phone.DeviceID, 1); !complete {
+		t.Fatal("resume from 1 should be complete")
+	}
+
+	ackEnv, _ := protocol.NewEnvelope(protocol.TypeAck, protocol.AckPayload{Seq: 3})
+	h.Ack(session, phone, ackEnv)
+	if frames, _ := session.replayTo("phone").since(phone.DeviceID, 0); len(frames) != 0 {
+		t.Fatalf("expected acked frames to be released, got %d", len(frames))
+	}
+}
+
+// resumeConn reconnects device of role on token, reporting lastSeq, and
+// returns the rseq of every frame resent to it.
+func resumeConn(t *testing.T, h *Hub, session *Session, role, device string, lastSeq uint64) []uint64 {
+	t.Helper()
+	conn := NewConnection(nil, "", nil)
+	authPayload, _ := json.Marshal(protocol.AuthPayload{Token: session.Token, Role: role, DeviceID: device, LastSeq: lastSeq})
+	if _, err := h.Authenticate(conn, &protocol.Envelope{Type: protocol.TypeAuth, Payload: authPayload}); err != nil {
+		t.Fatalf("Authenticate failed: %v", err)
+	}
+	for conn.Pending() > 0 {
+		conn.Next()
+	}
+	h.Resume(session, conn)
+	var seqs []uint64
+	for conn.Pending() > 0 {
+		seqs = append(seqs, recvEnvelope(t, conn).RSeq)
+	}
+	return seqs
+}
+
+func TestResumePerDevice(t *testing.T) {
+	store := newMockStore()
+	h := NewHub(store)
+	token, _ := h.CreateToken()
+
+	_, agent := authConn(t, h, token, "agent", "")
+	session, phone := authConn(t, h, token, "phone", "phone")
+	authConn(t, h, token, "phone", "tablet")
+
+	// rseq 1 and 2 go to both devices, 3 only to the tablet, 4 only to the phone
+	for _, device := range []string{"", "", "tablet", "phone"} {
+		env, _ := protocol.NewEnvelope(protocol.TypeChatToolStatus, map[string]string{"tool": "search"})
+		env.Device = device
+		raw, _ := env.Marshal()
+		if err := h.ForwardMessage(session, agent, env, raw); err != nil {
+			t.Fatalf("ForwardMessage failed: %v", err)
+		}
+	}
+
+	ackEnv, _ := protocol.NewEnvelope(protocol.TypeAck, protocol.AckPayload{Seq: 4})
+	h.Ack(session, phone, ackEnv)
+
+	if got := resumeConn(t, h, session, "phone", "tablet", 1); fmt.Sprint(got) != "[2 3]" {
+		t.Fatalf("tablet should get its own unacked frames, got %v", got)
+	}
+	if got := resumeConn(t, h, session, "phone", "phone", 1); len(got) != 0 {
+		t.Fatalf("phone acked everything sent to it, got %v", got)
+	}
+}
+
+func TestResumeAgentPool(t *testing.T) {
+	store := newMockStore()
+	h := NewHub(store)
+	token, _ := h.CreateToken()
+
+	_, a1 := authConn(t, h, token, "agent", "a1")
+	_, a2 := authConn(t, h, token, "agent", "a2")
+	session, phone := authConn(t, h, token, "phone", "")
+	for i := 0; i < 4; i++ {
+		env, _ := protocol.NewEnvelope(protocol.TypeChatSend, protocol.ChatSendPayload{Text: "hi"})
+		raw, _ := env.Marshal()
+		if err := h.ForwardMessage(session, phone, env, raw); err != nil {
+			t.Fatalf("ForwardMessage failed: %v", err)
+		}
+	}
+	received := make(map[string][]uint64)
+	for device, conn := range map[string]*Connection{"a1": a1, "a2": a2} {
+		for conn.Pending() > 0 {
+			if seq := recvEnvelope(t, conn).RSeq; seq > 1 {
+				received[device] = append(received[device], seq)
+			}
+		}
+	}
+
+	if len(received["a1"]) == 0 || len(received["a2"]) == 0 {
+		t.Fatalf("expected the pool to share the requests, got %v", received)
+	}
+	for _, device := range []string{"a1", "a2"} {
+		got := resumeConn(t, h, session, "agent", device, 1)
+		if fmt.Sprint(got) != fmt.Sprint(received[device]) {
+			t.Fatalf("%s should get only the requests it was given %v, got %v", device, received[device], got)
+		}
+	}
+}
+
+func TestRouteDefaultTable(t *testing.T) {
+	h := NewHub(newMockStore())
+
+	if _, err := h.Route("phone", protocol.TypeChatStream); err == nil {
+		t.Fatal("phone must not send chat.stream")
+	}
+	if route, err := h.Route("phone", protocol.TypeGroupSend); err != nil || route.Target != protocol.TargetPeer {
+		t.Fatalf("group.send should be forwarded, got %+v %v", route, err)
+	}
+	if route, err := h.Route("agent", protocol.TypePing); err != nil || route.Target != protocol.TargetRelay {
+		t.Fatalf("ping should be handled by the relay, got %+v %v", route, err)
+	}
+	if _, err := h.Route("phone", "bogus.type"); err == nil {
+		t.Fatal("unknown types should be rejected by default")
+	}
+}
+
+func TestRouteCustomTable(t *testing.T) {
+	routes := &protocol.RoutingTable{
+		Unknown: protocol.UnknownPass,
+		Routes: []protocol.Route{
+			{Type: "notes.*", From: []string{"agent"}, Target: protocol.TargetPeer},
+			{Type: "notes.edit", From: []string{"phone", "agent"}, Target: protocol.TargetPeer, Metered: true},
+		},
+	}
+	h := NewHubWithConfig(newMockStore(), Config{Routes: routes})
+
+	if _, err := h.Route("phone", "notes.sync"); err == nil {
+		t.Fatal("namespace wildcard should restrict notes.sync to agents")
+	}
+	if route, err := h.Route("phone", "notes.edit"); err != nil || !route.Metered {
+		t.Fatalf("exact route should win over wildcard, got %+v %v", route, err)
+	}
+	if route, err := h.Route("phone", "bogus.type"); err != nil || route.Target != protocol.TargetPeer {
+		t.Fatalf("unknown types should pass through, got %+v %v", route, err)
+	}
+}
+
+func TestUnmeteredRouteSkipsQuota(t *testing.T) {
+	store := newMockStore()
+	routes := &protocol.RoutingTable{Routes: []protocol.Route{
+		{Type: "typing", From: []string{"phone"}, Target: protocol.TargetPeer},
+	}}
+	h := NewHubWithConfig(store, Config{Routes: routes})
+	token, _ := h.CreateToken()
+
+	_, agent := authConn(t, h, token, "agent", "")
+	session, phone := authConn(t, h, token, "phone", "")
+	env, _ := protocol.NewEnvelope("typing", nil)
+	raw, _ := env.Marshal()
+	h.ForwardMessage(session, phone, env, raw)
+
+	recvEnvelope(t, agent)
+	if usage, _ := store.GetDailyUsage(token); usage != 0 {
+		t.Fatalf("unmetered route should not count against quota, got %d", usage)
+	}
+}
+
+func TestDeliveredReceipt(t *testing.T) {
+	store := newMockStore()
+	h := NewHub(store)
+	token, _ := h.CreateToken()
+
+	_, phone := authConn(t, h, token, "phone", "phone")
+	_, tablet := authConn(t, h, token, "phone", "tablet")
+	agent := NewConnection(nil, "", nil)
+	authPayload, _ := json.Marshal(protocol.AuthPayload{Token: token, Role: "agent", Receipts: true})
+	session, _ := h.Authenticate(agent, &protocol.Envelope{Type: protocol.TypeAuth, Payload: authPayload})
+
+	env, _ := protocol.NewEnvelope(protocol.TypeChatDone, protocol.ChatDonePayload{FullText: "done"})
+	raw, _ := env.Marshal()
+	h.ForwardMessage(session, agent, env, raw)
+
+	// No receipt until the write pump reports the frame written
+	if agent.Pending() != 0 {
+		t.Fatal("receipt must wait for the socket write")
+	}
+	for _, c := range []*Connection{phone, tablet} {
+		frame, _ := c.Next()
+		frame.OnWritten()
+	}
+
+	got := recvEnvelope(t, agent)
+	var receipt protocol.DeliveredPayload
+	got.ParsePayload(&receipt)
+	if got.Type != protocol.TypeDelivered || receipt.ID != env.ID {
+		t.Fatalf("expected delivered receipt for %s, got %s %+v", env.ID, got.Type, receipt)
+	}
+	if agent.Pending() != 0 {
+		t.Fatal("fan-out should produce a single receipt")
+	}
+}
+
+func TestStreamCoalescingWhenBacklogged(t *testing.T) {
+	store := newMockStore()
+	h := NewHub(store)
+	token, _ := h.CreateToken()
+
+	_, agent := authConn(t, h, token, "agent", "")
+	session, phone := authConn(t, h, token, "phone", "")
+
+	// Fill the phone's queue up to the watermark with unrelated frames
+	for i := 0; i < coalesceWatermark-1; i++ {
+		phone.Enqueue(Frame{Data: []byte("{}")})
+	}
+	for i, delta := range []string{"Hel", "lo", " world"} {
+		env, _ := protocol.NewEnvelope(protocol.TypeChatStream, protocol.ChatStreamPayload{Delta: delta, Seq: i + 1})
+		raw, _ := env.Marshal()
+		if err := h.ForwardMessage(session, agent, env, raw); err != nil {
+			t.Fatalf("ForwardMessage failed: %v", err)
+		}
+	}
+
+	if phone.Pending() != coalesceWatermark {
+		t.Fatalf("expected deltas merged into one frame, got %d queued", phone.Pending())
+	}
+	for i := 0; i < coalesceWatermark-1; i++ {
+		phone.Next()
+	}
+	var chunk protocol.ChatStreamPayload
+	recvEnvelope(t, phone).ParsePayload(&chunk)
+	if chunk.Delta != "Hello world" || chunk.Seq != 3 || chunk.SeqStart != 1 {
+		t.Fatalf("unexpected merged chunk: %+v", chunk)
+	}
+}
+
+func TestEncryptedStreamBackpressure(t *testing.T) {
+	store := newMockStore()
+	h := NewHub(store)
+	token, _ := h.CreateToken()
+
+	_, agent := authConn(t, h, token, "agent", "")
+	session, phone := authConn(t, h, token, "phone", "")
+	for phone.Enqueue(Frame{Data: []byte("{}")}) {
+	}
+
+	env, _ := protocol.NewEnvelope(protocol.TypeChatStream, map[string]interface{}{"enc": true, "ciphertext": "x", "nonce": "y"})
+	raw, _ := env.Marshal()
+	done := make(chan struct{})
+	go func() {
+		h.ForwardMessage(session, agent, env, raw)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("encrypted stream should wait for room instead of failing")
+	case <-time.After(50 * time.Millisecond):
+	}
+	phone.Next()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("sender should resume once the peer drains")
+	}
+	if agent.Pending() != 0 {
+		t.Fatal("sender should not get an error")
+	}
+}
+
+func TestHubCountsLaneDrops(t *testing.T) {
+	store := newMockStore()
+	h := NewHub(store)
+	token, _ := h.CreateToken()
+
+	_, agent := authConn(t, h, token, "agent", "")
+	session, phone := authConn(t, h, token, "phone", "")
+	for agent.Enqueue(Frame{Data: []byte("{}")}) {
+	}
+
+	env, _ := protocol.NewEnvelope(protocol.TypeChatSend, protocol.ChatSendPayload{Text: "hi"})
+	raw, _ := env.Marshal()
+	h.ForwardMessage(session, phone, env, raw)
+
+	if h.DroppedFrames(LaneBulk) != 2 {
+		t.Fatalf("expected 2 bulk drops, got %d", h.DroppedFrames(LaneBulk))
+	}
+	// The sender still hears about the failure on its control lane
+	if got := recvEnvelope(t, phone); got.Type != protocol.TypeChatError {
+		t.Fatalf("expected chat.error, got %s", got.Type)
+	}
+}
+
+func TestDrainWaitsForStreams(t *testing.T) {
+	store := newMockStore()
+	h := NewHub(store)
+	token, _ := h.CreateToken()
+
+	_, agent := authConn(t, h, token, "agent", "")
+	session, phone := authConn(t, h, token, "phone", "")
+	phone.Next() // agent online status
+
+	chunk, _ := protocol.NewEnvelope(protocol.TypeChatStream, protocol.ChatStreamPayload{Delta: "Hi", Seq: 1})
+	raw, _ := chunk.Marshal()
+	h.ForwardMessage(session, agent, chunk, raw)
+	if h.ActiveStreams() != 1 {
+		t.Fatalf("expected 1 active stream, got %d", h.ActiveStreams())
+	}
+
+	drained := make(chan struct{})
+	go func() {
+		h.Drain(context.Background(), time.Now().Add(5*time.Second))
+		close(drained)
+	}()
+	for !h.Draining() {
+		time.Sleep(time.Millisecond)
+	}
+	if _, err := h.Authenticate(NewConnection(nil, "", nil), &protocol.Envelope{Type: protocol.TypeAuth, Payload: json.RawMessage(`{"token":"` + token + `","role":"phone"}`)}); err != ErrDraining {
+		t.Fatalf("expected ErrDraining, got %v", err)
+	}
+
+	time.Sleep(2 * drainPollInterval)
+	if isClosed(phone.Done) {
+		t.Fatal("connection closed while a stream was in flight")
+	}
+
+	done, _ := protocol.NewEnvelope(protocol.TypeChatDone, protocol.ChatDonePayload{FullText: "Hi"})
+	raw, _ = done.Marshal()
+	h.ForwardMessage(session, agent, done, raw)
+
+	select {
+	case <-phone.Done:
+	case <-time.After(time.Second):
+		t.Fatal("expected connections closed once the stream finished")
+	}
+	if code, _ := phone.CloseCode(); code != websocket.CloseServiceRestart {
+		t.Fatalf("expected close code %d, got %d", websocket.CloseServiceRestart, code)
+	}
+	var sawReconnect bool
+	for phone.Pending() > 0 {
+		if recvEnvelope(t, phone).Type == protocol.TypeSystemReconnect {
+			sawReconnect = true
+		}
+	}
+	if !sawReconnect {
+		t.Fatal("expected a system.reconnect hint")
+	}
+
+	h.Disconnect(session, phone)
+	h.Disconnect(session, agent)
+	<-drained
+}
+
+func TestPresenceSetAndCachedPresence(t *testing.T) {
+	store := newMockStore()
+	h := NewHub(store)
+	token, _ := h.CreateToken()
+
+	agent := NewConnection(nil, "", nil)
+	authPayload, _ := json.Marshal(protocol.AuthPayload{Token: token, Role: "agent", Client: "bridge/2.1", Platform: "macos"})
+	session, err := h.Authenticate(agent, &protocol.Envelope{Type: protocol.TypeAuth, Payload: authPayload})
+	if err != nil {
+		t.Fatalf("Authenticate failed: %v", err)
+	}
+	_, phone := authConn(t, h, token, "phone", "")
+
+	set, _ := protocol.NewEnvelope(protocol.TypePresenceSet, protocol.PresenceSetPayload{State: protocol.PresenceBusy})
+	h.SetPresence(session, agent, set)
+
+	var status protocol.StatusPayload
+	recvEnvelope(t, phone).ParsePayload(&status)
+	if len(status.Devices) != 1 || status.Devices[0].State != protocol.PresenceBusy {
+		t.Fatalf("expected busy agent, got %+v", status)
+	}
+
+	// A newcomer learns the cached presence in auth.ok
+	_, tablet := authConn(t, h, token, "phone", "tablet")
+	ok := h.AuthOk(session, tablet)
+	if len(ok.Presence) != 1 {
+		t.Fatalf("expected agent presence in auth.ok, got %+v", ok.Presence)
+	}
+	p := ok.Presence[0]
+	if p.Status != protocol.StatusOnline || p.State != protocol.PresenceBusy || p.Client != "bridge/2.1" || p.Platform != "macos" || p.LastSeen == 0 {
+		t.Fatalf("unexpected agent presence: %+v", p)
+	}
+
+	h.Disconnect(session, agent)
+	recvEnvelope(t, phone).ParsePayload(&status)
+	if status.Peer != protocol.StatusOffline || status.Devices[0].Status != protocol.StatusOffline {
+		t.Fatalf("expected offline agent, got %+v", status)
+	}
+
+	bad, _ := protocol.NewEnvelope(protocol.TypePresenceSet, protocol.PresenceSetPayload{State: "sleeping"})
+	h.SetPresence(session, phone, bad)
+	if got := recvEnvelope(t, phone); got.Type != protocol.TypeChatError {
+		t.Fatalf("expected chat.error for invalid state, got %s", got.Type)
+	}
+}
+
+func TestRequestTimeoutAndDisconnect(t *testing.T) {
+	store := newMockStore()
+	h := NewHubWithConfig(store, Config{RequestTimeout: 50 * time.Millisecond})
+	token, _ := h.CreateToken()
+
+	_, agent := authConn(t, h, token, "agent", "")
+	session, phone := authConn(t, h, token, "phone", "")
+
+	send := func(from *Connection, msgType string, replyTo string) *protocol.Envelope {
+		env, _ := protocol.NewEnvelope(msgType, map[string]string{})
+		env.ReplyTo = replyTo
+		raw, _ := env.Marshal()
+		h.ForwardMessage(session, from, env, raw)
+		return env
+	}
+	expectError := func(code, id string) {
+		t.Helper()
+		env := recvEnvelope(t, phone)
+		var payload protocol.ErrorPayload
+		env.ParsePayload(&payload)
+		if env.Type != protocol.TypeChatError || payload.Code != code || payload.RequestID != id || env.ReplyTo != id {
+			t.Fatalf("expected %s for %s, got %s %+v", code, id, env.Type, payload)
+		}
+	}
+
+	// Answered requests are forgotten, matched by type or reply_to
+	send(phone, protocol.TypeAgentList, "")
+	history := send(phone, protocol.TypeChatHistory, "")
+	send(agent, protocol.TypeAgentListResult, "")
+	send(agent, protocol.TypeChatHistoryResult, history.ID)
+	recvEnvelope(t, phone)
+	recvEnvelope(t, phone)
+
+	search := send(phone, protocol.TypeMemorySearch, "")
+	time.Sleep(150 * time.Millisecond)
+	if phone.Pending() != 1 {
+		t.Fatalf("expected only the timeout error, got %d frames", phone.Pending())
+	}
+	expectError(protocol.ErrRequestTimeout, search.ID)
+
+	status := send(phone, protocol.TypeSystemStatus, "")
+	h.Disconnect(session, agent)
+	expectError(protocol.ErrPeerDisconnected, status.ID)
+}
+
+// slowRecordStore holds the first RecordBytes call until release is closed.
+type slowRecordStore struct {
+	*mockStore
+	first   atomic.Bool
+	release chan struct{}
+}
+
+func (s *slowRecordStore) RecordBytes(token string, bytes int64) error {
+	if s.first.CompareAndSwap(false, true) {
+		<-s.release
+	}
+	return s.mockStore.RecordBytes(token, bytes)
+}
+
+func TestRequestAnsweredBeforeSendReturns(t *testing.T) {
+	store := &slowRecordStore{mockStore: newMockStore(), release: make(chan struct{})}
+	h := NewHubWithConfig(store, Config{RequestTimeout: 50 * time.Millisecond})
+	token, _ := h.CreateToken()
+
+	_, agent := authConn(t, h, token, "agent", "")
+	session, phone := authConn(t, h, token, "phone", "")
+	phone.Next() // agent online status
+
+	// The agent answers while the phone's send is still recording quota
+	list, _ := protocol.NewEnvelope(protocol.TypeAgentList, map[string]string{})
+	raw, _ := list.Marshal()
+	sent := make(chan struct{})
+	go func() {
+		h.ForwardMessage(session, phone, list, raw)
+		close(sent)
+	}()
+	for agent.Pending() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	agent.Next()
+	result, _ := protocol.NewEnvelope(protocol.TypeAgentListResult, map[string]string{})
+	raw, _ = result.Marshal()
+	h.ForwardMessage(session, agent, result, raw)
+	close(store.release)
+	<-sent
+
+	time.Sleep(150 * time.Millisecond)
+	if got := recvEnvelope(t, phone); got.Type != protocol.TypeAgentListResult {
+		t.Fatalf("expected the result, got %s", got.Type)
+	}
+	if phone.Pending() != 0 {
+		t.Fatalf("answered request timed out anyway: %s", recvEnvelope(t, phone).Type)
+	}
+}
+
+func TestStreamInterruptedOnAgentDisconnect(t *testing.T) {
+	store := newMockStore()
+	h := NewHub(store)
+	token, _ := h.CreateToken()
+
+	_, agent := authConn(t, h, token, "agent", "")
+	session, phone := authConn(t, h, token, "phone", "")
+
+	forward := func(msgType string, payload interface{}) {
+		env, _ := protocol.NewEnvelope(msgType, payload)
+		raw, _ := env.Marshal()
+		h.ForwardMessage(session, agent, env, raw)
+	}
+	forward(protocol.TypeChatStream, protocol.ChatStreamPayload{Delta: "a", Seq: 1, StreamID: "done"})
+	forward(protocol.TypeChatDone, protocol.ChatDonePayload{FullText: "a", StreamID: "done"})
+	forward(protocol.TypeChatStream, protocol.ChatStreamPayload{Delta: "b", Seq: 1, StreamID: "open"})
+	forward(protocol.TypeChatStream, protocol.ChatStreamPayload{Delta: "c", Seq: 2, StreamID: "open"})
+	for phone.Pending() > 0 {
+		phone.Next()
+	}
+
+	h.Disconnect(session, agent)
+
+	env := recvEnvelope(t, phone)
+	var payload protocol.ErrorPayload
+	env.ParsePayload(&payload)
+	if env.Type != protocol.TypeChatError || payload.Code != protocol.ErrStreamInterrupted || payload.StreamID != "open" || payload.LastSeq != 2 {
+		t.Fatalf("expected STREAM_INTERRUPTED at seq 2, got %s %+v", env.Type, payload)
+	}
+	if got := recvEnvelope(t, phone); got.Type != protocol.TypeStatus {
+		t.Fatalf("expected only one interrupted stream, then status; got %s", got.Type)
+	}
+	if h.ActiveStreams() != 0 {
+		t.Fatalf("expected no active streams, got %d", h.ActiveStreams())
+	}
+}
+
+func TestChatErrorEndsOnlyItsStream(t *testing.T) {
+	store := newMockStore()
+	h := NewHub(store)
+	token, _ := h.CreateToken()
+
+	_, agent := authConn(t, h, token, "agent", "")
+	session, _ := authConn(t, h, token, "phone", "")
+
+	forward := func(msgType string, payload interface{}) {
+		env, _ := protocol.NewEnvelope(msgType, payload)
+		raw, _ := env.Marshal()
+		h.ForwardMessage(session, agent, env, raw)
+	}
+	forward(protocol.TypeChatStream, protocol.ChatStreamPayload{Delta: "a", Seq: 1, StreamID: "a"})
+	forward(protocol.TypeChatStream, protocol.ChatStreamPayload{Delta: "b", Seq: 1, StreamID: "b"})
+
+	forward(protocol.TypeChatError, protocol.ErrorPayload{Code: "TOOL_FAILED", Message: "search failed"})
+	if h.ActiveStreams() != 2 {
+		t.Fatalf("an error naming no stream must leave named streams open, got %d", h.ActiveStreams())
+	}
+	forward(protocol.TypeChatError, protocol.ErrorPayload{Code: "MODEL_ERROR", Message: "failed", StreamID: "a"})
+	if h.ActiveStreams() != 1 {
+		t.Fatalf("expected only stream b open, got %d", h.ActiveStreams())
+	}
+}
+
+func TestStreamEndsWhilePhoneOffline(t *testing.T) {
+	for name, queue := range map[string]OfflineQueue{"queued": {Mailbox: newMockMailbox()}, "refused": {}} {
+		h := NewHubWithConfig(newMockStore(), Config{OfflineQueue: queue})
+		token, _ := h.CreateToken()
+
+		_, agent := authConn(t, h, token, "agent", "")
+		session, phone := authConn(t, h, token, "phone", "")
+		forward := func(msgType string, payload interface{}) {
+			env, _ := protocol.NewEnvelope(msgType, payload)
+			raw, _ := env.Marshal()
+			h.ForwardMessage(session, agent, env, raw)
+		}
+		forward(protocol.TypeChatStream, protocol.ChatStreamPayload{Delta: "a", Seq: 1})
+		h.Disconnect(session, phone)
+
+		forward(protocol.TypeChatDone, protocol.ChatDonePayload{FullText: "a"})
+		// Drain would otherwise wait for this stream until its deadline
+		if h.ActiveStreams() != 0 {
+			t.Fatalf("%s: chat.done for an offline phone left %d streams open", name, h.ActiveStreams())
+		}
+
+		_, phone = authConn(t, h, token, "phone", "")
+		for phone.Pending() > 0 {
+			phone.Next()
+		}
+		h.Disconnect(session, agent)
+		if got := recvEnvelope(t, phone); got.Type != protocol.TypeStatus {
+			t.Fatalf("%s: expected only the agent going offline, got %s", name, got.Type)
+		}
+	}
+}
+
+func TestEphemeralMessagesAreBestEffort(t *testing.T) {
+	store := newMockStore()
+	mailbox := newMockMailbox()
+	h := NewHubWithConfig(store, Config{OfflineQueue: OfflineQueue{Mailbox: mailbox}})
+	token, _ := h.CreateToken()
+
+	session, phone := authConn(t, h, token, "phone", "")
+	phone.Limiter = rate.NewLimiter(0, 0) // any metered message would be refused
+
+	typing, _ := protocol.NewEnvelope(protocol.TypeEphemeralTyping, protocol.TypingPayload{Active: true})
+	raw, _ := typing.Marshal()
+
+	// No agent: dropped silently instead of queued
+	h.ForwardMessage(session, phone, typing, raw)
+	if count, _, _ := mailbox.MailboxUsage(token, "agent"); count != 0 || phone.Pending() != 0 {
+		t.Fatalf("expected silent drop, got %d queued and %d frames to sender", count, phone.Pending())
+	}
+
+	_, agent := authConn(t, h, token, "agent", "")
+	h.ForwardMessage(session, phone, typing, raw)
+	got := recvEnvelope(t, agent)
+	if got.Type != protocol.TypeEphemeralTyping || got.RSeq != 0 {
+		t.Fatalf("expected unsequenced typing indicator, got %s rseq=%d", got.Type, got.RSeq)
+	}
+	if usage, _ := store.GetDailyUsage(token); usage != 0 || phone.Pending() != 0 {
+		t.Fatalf("ephemeral message was accounted: usage %d, %d frames to sender", usage, phone.Pending())
+	}
+}
+
+func TestEphemeralSizeLimit(t *testing.T) {
+	store := newMockStore()
+	h := NewHub(store)
+	token, _ := h.CreateToken()
+
+	_, agent := authConn(t, h, token, "agent", "")
+	session, phone := authConn(t, h, token, "phone", "")
+
+	big, _ := protocol.NewEnvelope("ephemeral.cursor", map[string]string{"blob": strings.Repeat("x", ratelimit.MaxEphemeralSize)})
+	raw, _ := big.Marshal()
+	h.ForwardMessage(session, phone, big, raw)
+
+	got := recvEnvelope(t, phone)
+	var p protocol.ErrorPayload
+	got.ParsePayload(&p)
+	if got.Type != protocol.TypeChatError || p.Code != protocol.ErrMessageTooLarge {
+		t.Fatalf("expected MESSAGE_TOO_LARGE, got %s %+v", got.Type, p)
+	}
+	if agent.Pending() != 0 {
+		t.Fatal("oversized ephemeral message was forwarded")
+	}
+}
+
+func TestBroadcastFilters(t *testing.T) {
+	store := newMockStore()
+	h := NewHub(store)
+	tokenA, _ := h.CreateToken()
+	tokenB, _ := h.CreateToken()
+
+	_, phoneA := authConn(t, h, tokenA, "phone", "")
+	_, agentA := authConn(t, h, tokenA, "agent", "")
+	_, phoneB := authConn(t, h, tokenB, "phone", "")
+
+	notice := protocol.NoticePayload{Message: "restarting in 5 minutes", Level: "warning"}
+	result, err := h.Broadcast(notice, BroadcastFilter{Role: "phone"})
+	if err != nil || result.Sessions != 2 || result.Delivered != 2 {
+		t.Fatalf("role broadcast: %+v %v", result, err)
+	}
+	if agentA.Pending() != 0 {
+		t.Fatal("agent should not receive a phone-only broadcast")
+	}
+	var payload protocol.NoticePayload
+	env := recvEnvelope(t, phoneB)
+	env.ParsePayload(&payload)
+	if env.Type != protocol.TypeSystemNotice || payload != notice {
+		t.Fatalf("unexpected notice: %s %+v", env.Type, payload)
+	}
+	phoneA.Next()
+
+	result, _ = h.Broadcast(notice, BroadcastFilter{Tokens: []string{tokenA, tokenA, "unknown"}})
+	if result.Sessions != 1 || result.Delivered != 2 || phoneB.Pending() != 0 {
+		t.Fatalf("token broadcast: %+v", result)
+	}
+}
+
+func TestTakeoverPolicies(t *testing.T) {
+	store := newMockStore()
+	h := NewHub(store)
+	token, _ := h.CreateToken()
+
+	// replace (default): the old connection is told and closed with 4001
+	session, first := authConn(t, h, token, "phone", "")
+	_, second := authConn(t, h, token, "phone", "")
+	if !isClosed(first.Done) {
+		t.Fatal("replaced connection should be closed")
+	}
+	if code, _ := first.CloseCode(); code != protocol.CloseReplaced {
+		t.Fatalf("expected close code %d, got %d", protocol.CloseReplaced, code)
+	}
+	if got := recvEnvelope(t, first); got.Type != protocol.TypeSessionReplaced {
+		t.Fatalf("expected session.replaced, got %s", got.Type)
+	}
+
+	// reject: the newcomer is refused and the existing connection stays
+	if err := h.SetTakeoverPolicy(token, TakeoverReject); err != nil {
+		t.Fatalf("SetTakeoverPolicy failed: %v", err)
+	}
+	authPayload, _ := json.Marshal(protocol.AuthPayload{Token: token, Role: "phone"})
+	if _, err := h.Authenticate(NewConnection(nil, "", nil), &protocol.Envelope{Type: protocol.TypeAuth, Payload: authPayload}); err != ErrSessionInUse {
+		t.Fatalf("expected ErrSessionInUse, got %v", err)
+	}
+	if isClosed(second.Done) || session.DeviceConn("phone", protocol.DefaultDevice) != second {
+		t.Fatal("rejecting a newcomer must not disturb the existing connection")
+	}
+
+	// allow_both: the newcomer gets its own device ID
+	h.SetTakeoverPolicy(token, TakeoverAllowBoth)
+	_, third := authConn(t, h, token, "phone", "")
+	if third.DeviceID != "default~2" || isClosed(second.Done) || len(session.Conns("phone")) != 2 {
+		t.Fatalf("expected both connections kept, newcomer as default~2, got %s", third.DeviceID)
+	}
+	if ok := h.AuthOk(session, third); ok.DeviceID != "default~2" {
+		t.Fatalf("auth.ok should report the assigned device, got %q", ok.DeviceID)
+	}
+
+	if err := h.SetTakeoverPolicy(token, "bogus"); err == nil {
+		t.Fatal("expected invalid policy to be rejected")
+	}
+	if err := h.SetTakeoverPolicy("oc_pair_unknown", TakeoverReject); err != ErrInvalidToken {
+		t.Fatalf("expected ErrInvalidToken, got %v", err)
+	}
+}
+
+func TestObserverReceivesEvents(t *testing.T) {
+	var mu sync.Mutex
+	var events []Event
+	record := ObserverFunc(func(e Event) {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, e)
+	})
+	store := newMockStore()
+	h := NewHubWithConfig(store, Config{Observers: []Observer{record}})
+	token, _ := h.CreateToken()
+
+	_, agent := authConn(t, h, token, "agent", "")
+	session, phone := authConn(t, h, token, "phone", "")
+	h.Authenticate(NewConnection(nil, "", nil), &protocol.Envelope{Type: protocol.TypeAuth, Payload: json.RawMessage(`{"token":"bogus","role":"phone"}`)})
+
+	env, _ := protocol.NewEnvelope(protocol.TypeChatSend, protocol.ChatSendPayload{Text: "hi"})
+	raw, _ := env.Marshal()
+	h.ForwardMessage(session, phone, env, raw)
+	bad, _ := protocol.NewEnvelope("bogus.type", nil)
+	h.ForwardMessage(session, phone, bad, []byte("{}"))
+	h.Disconnect(session, agent)
+
+	want := []EventKind{EventAuth, EventAuth, EventPaired, EventAuthFailed, EventForward, EventRejected, EventDisconnect, EventUnpaired}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(events) != len(want) {
+		t.Fatalf("expected %d events, got %d: %v", len(want), len(events), events)
+	}
+	for i, kind := range want {
+		if events[i].Kind != kind {
+			t.Fatalf("event %d: expected %s, got %s", i, kind, events[i].Kind)
+		}
+	}
+	if fwd := events[4]; fwd.Token != token || fwd.Role != "phone" || fwd.Type != protocol.TypeChatSend || fwd.Peers != 1 || fwd.Bytes == 0 {
+		t.Fatalf("unexpected forward event: %+v", fwd)
+	}
+	if rej := events[5]; rej.Code != protocol.ErrInvalidMessage {
+		t.Fatalf("unexpected reject event: %+v", rej)
+	}
+	if events[3].Err != ErrInvalidToken {
+		t.Fatalf("expected auth failure cause, got %v", events[3].Err)
+	}
+}
+
+func TestInterceptorChain(t *testing.T) {
+	var order []string
+	trace := func(name string) Interceptor {
+		return func(m *Message, next Handler) error {
+			order = append(order, name)
+			return next(m)
+		}
+	}
+	block := func(m *Message, next Handler) error {
+		var chat protocol.ChatSendPayload
+		if m.Env.ParsePayload(&chat) == nil && strings.Contains(chat.Text, "sk-") {
+			return Reject(protocol.ErrInvalidMessage, "Message contains a secret", 0)
+		}
+		return next(m)
+	}
+	drop := func(m *Message, next Handler) error {
+		if m.Env.Type == protocol.TypeChatHistory {
+			return ErrDrop
+		}
+		return next(m)
+	}
+	rewrite := func(m *Message, next Handler) error {
+		var chat protocol.ChatSendPayload
+		if m.Env.ParsePayload(&chat) == nil && chat.Text == "hi" {
+			env, _ := protocol.NewEnvelope(m.Env.Type, protocol.ChatSendPayload{Text: "hello"})
+			env.ID = m.Env.ID
+			if err := m.SetEnvelope(env); err != nil {
+				return err
+			}
+		}
+		return next(m)
+	}
+
+	var dropped int
+	store := newMockStore()
+	links := append([]Interceptor{trace("first")}, DefaultInterceptors()...)
+	links = append(links, block, drop, rewrite, trace("last"))
+	h := NewHubWithConfig(store, Config{
+		Interceptors: links,
+		Observers: []Observer{ObserverFunc(func(e Event) {
+			if e.Kind == EventDropped {
+				dropped++
+			}
+		})},
+	})
+	token, _ := h.CreateToken()
+	_, agent := authConn(t, h, token, "agent", "")
+	session, phone := authConn(t, h, token, "phone", "")
+
+	send := func(msgType string, payload interface{}) {
+		t.Helper()
+		env, _ := protocol.NewEnvelope(msgType, payload)
+		raw, _ := env.Marshal()
+		h.ForwardMessage(session, phone, env, raw)
+	}
+
+	send(protocol.TypeChatSend, protocol.ChatSendPayload{Text: "hi"})
+	got := recvEnvelope(t, agent)
+	var chat protocol.ChatSendPayload
+	got.ParsePayload(&chat)
+	if chat.Text != "hello" || got.Device != phone.DeviceID {
+		t.Fatalf("expected rewritten, device-tagged message, got %q from %q", chat.Text, got.Device)
+	}
+	if strings.Join(order, ",") != "first,last" {
+		t.Fatalf("unexpected chain order: %v", order)
+	}
+
+	send(protocol.TypeChatSend, protocol.ChatSendPayload{Text: "key sk-123"})
+	if agent.Pending() != 0 {
+		t.Fatal("rejected message must not be forwarded")
+	}
+	if errEnv := recvEnvelope(t, phone); errEnv.Type != protocol.TypeChatError {
+		t.Fatalf("expected chat.error, got %s", errEnv.Type)
+	}
+
+	send(protocol.TypeChatHistory, struct{}{})
+	if agent.Pending() != 0 || phone.Pending() != 0 || dropped != 1 {
+		t.Fatalf("expected a silent drop, agent=%d phone=%d dropped=%d", agent.Pending(), phone.Pending(), dropped)
+	}
+
+	// Built-in links still apply when reordered among custom ones.
+	send("bogus.type", struct{}{})
+	var rej protocol.ErrorPayload
+	recvEnvelope(t, phone).ParsePayload(&rej)
+	if rej.Code != protocol.ErrInvalidMessage {
+		t.Fatalf("expected INVALID_MESSAGE from RouteCheck, got %s", rej.Code)
+	}
+}
+
+func TestMessageTTLExpiry(t *testing.T) {
+	store := newMockStore()
+	mailbox := newMockMailbox()
+	h := NewHubWithConfig(store, Config{OfflineQueue: OfflineQueue{Mailbox: mailbox}})
+	token, _ := h.CreateToken()
+	session, phone := authConn(t, h, token, "phone", "")
+
+	send := func(text string, ttlMs int64) *protocol.Envelope {
+		env, _ := protocol.NewEnvelope(protocol.TypeChatSend, protocol.ChatSendPayload{Text: text})
+		env.TTLMs = ttlMs
+		raw, _ := env.Marshal()
+		h.ForwardMessage(session, phone, env, raw)
+		return env
+	}
+	expectExpired := func(id string) {
+		t.Helper()
+		got := recvEnvelope(t, phone)
+		var p protocol.ErrorPayload
+		got.ParsePayload(&p)
+		if got.Type != protocol.TypeChatError || p.Code != protocol.ErrExpired || got.ReplyTo != id {
+			t.Fatalf("expected EXPIRED for %s, got %s %+v reply_to=%s", id, got.Type, p, got.ReplyTo)
+		}
+	}
+
+	// Queued while the agent is offline: the stale message is dropped on
+	// replay, the one without a TTL is delivered.
+	stale := send("stale", 20)
+	send("keep", 0)
+	time.Sleep(30 * time.Millisecond)
+	_, agent := authConn(t, h, token, "agent", "")
+	h.DeliverQueued(session, agent)
+	var p protocol.ChatSendPayload
+	recvEnvelope(t, agent).ParsePayload(&p)
+	if p.Text != "keep" || agent.Pending() != 0 {
+		t.Fatalf("expected only the message without TTL, got %q (+%d)", p.Text, agent.Pending())
+	}
+	expectExpired(stale.ID)
+	if count, _, _ := mailbox.MailboxUsage(token, "agent"); count != 0 {
+		t.Fatalf("expired message should leave the mailbox, got %d", count)
+	}
+
+	// Sitting in the agent's send queue past its TTL.
+	late := send("late", 20)
+	send("fresh", 60000)
+	time.Sleep(30 * time.Millisecond)
+	recvEnvelope(t, agent).ParsePayload(&p)
+	if p.Text != "fresh" || agent.Pending() != 0 {
+		t.Fatalf("expected the expired frame to be skipped, got %q", p.Text)
+	}
+	expectExpired(late.ID)
+	if phone.Pending() != 0 {
+		t.Fatal("sender should be notified once")
+	}
+}
+
+func TestQueuedReplyExpiryReachesAgent(t *testing.T) {
+	store := newMockStore()
+	mailbox := newMockMailbox()
+	h := NewHubWithConfig(store, Config{OfflineQueue: OfflineQueue{Mailbox: mailbox}})
+	token, _ := h.CreateToken()
+
+	session, agent := authConn(t, h, token, "agent", "a1")
+	env, _ := protocol.NewEnvelope(protocol.TypeChatHistoryResult, map[string]string{})
+	env.Device = "tablet"
+	env.TTLMs = 20
+	raw, _ := env.Marshal()
+	if err := h.ForwardMessage(session, agent, env, raw); err != nil {
+		t.Fatalf("ForwardMessage failed: %v", err)
+	}
+	time.Sleep(30 * time.Millisecond)
+
+	_, tablet := authConn(t, h, token, "phone", "tablet")
+	h.DeliverQueued(session, tablet)
+	if tablet.Pending() != 0 {
+		t.Fatal("expired reply was delivered")
+	}
+	got := recvEnvelope(t, agent)
+	var p protocol.ErrorPayload
+	got.ParsePayload(&p)
+	if got.Type != protocol.TypeChatError || p.Code != protocol.ErrExpired || got.ReplyTo != env.ID {
+		t.Fatalf("expected EXPIRED for the agent, got %s %+v", got.Type, p)
+	}
+}
+
+func TestBinaryEncodingTranscodes(t *testing.T) {
+	store := newMockStore()
+	h := NewHub(store)
+	token, _ := h.CreateToken()
+
+	authPayload, _ := json.Marshal(protocol.AuthPayload{Token: token, Role: "phone", Encoding: protocol.EncodingCBOR})
+	phone := NewConnection(nil, "", nil)
+	session, err := h.Authenticate(phone, &protocol.Envelope{Type: protocol.TypeAuth, Payload: authPayload})
+	if err != nil {
+		t.Fatalf("Authenticate failed: %v", err)
+	}
+	if ok := h.AuthOk(session, phone); ok.Encoding != protocol.EncodingCBOR {
+		t.Fatalf("expected cbor in auth.ok, got %q", ok.Encoding)
+	}
+	_, agent := authConn(t, h, token, "agent", "")
+
+	image := bytes.Repeat([]byte{0xff, 0xd8, 0x00}, 1000)
+	env, _ := protocol.NewEnvelope(protocol.TypeChatSend, protocol.ChatSendPayload{
+		Text:        "look",
+		Attachments: []protocol.Attachment{{Type: "image", MimeType: "image/jpeg", ContentB64: base64.StdEncoding.EncodeToString(image)}},
+	})
+	raw, _ := env.Marshal()
+	wire, err := protocol.EncodeBinary(raw)
+	if err != nil {
+		t.Fatalf("EncodeBinary failed: %v", err)
+	}
+	if len(wire) >= len(raw) || len(wire) > len(image)+200 {
+		t.Fatalf("expected raw image bytes on the wire, got %d bytes for a %d byte image", len(wire), len(image))
+	}
+	decoded, err := protocol.DecodeBinary(wire)
+	if err != nil {
+		t.Fatalf("DecodeBinary failed: %v", err)
+	}
+	var got protocol.Envelope
+	json.Unmarshal(decoded, &got)
+	h.Forward(&Message{Session: session, Sender: phone, Env: &got, Raw: decoded, Size: len(wire)})
+
+	// The JSON agent receives base64 and is metered for it.
+	var send protocol.ChatSendPayload
+	recvEnvelope(t, agent).ParsePayload(&send)
+	if len(send.Attachments) != 1 || send.Attachments[0].ContentB64 != base64.StdEncoding.EncodeToString(image) {
+		t.Fatal("attachment did not survive transcoding")
+	}
+
+	// The CBOR phone receives binary frames with byte strings.
+	reply, _ := protocol.NewEnvelope(protocol.TypeChatHistoryResult, map[string]interface{}{
+		"attachments": []protocol.Attachment{{Type: "image", ContentB64: base64.StdEncoding.EncodeToString(image)}},
+	})
+	replyRaw, _ := reply.Marshal()
+	h.ForwardMessage(session, agent, reply, replyRaw)
+	frame, ok := phone.Next()
+	if !ok || !frame.Binary {
+		t.Fatal("expected a binary frame for the cbor phone")
+	}
+	if !bytes.Contains(frame.Data, image) {
+		t.Fatal("expected the attachment as a byte string")
+	}
+	if sent := agent.BytesSent.Load(); sent != int64(len(frame.Data)) {
+		t.Fatalf("expected metering by wire size %d, got %d", len(frame.Data), sent)
+	}
+
+	// Relay-generated frames are encoded when written.
+	h.sendError(phone, protocol.ErrRateLimited, "slow down", 0)
+	frame, _ = phone.Next()
+	if frame = phone.Encode(frame); !frame.Binary {
+		t.Fatal("expected control frames to be encoded for the cbor phone")
+	}
+	data, _ := protocol.DecodeBinary(frame.Data)
+	var errEnv protocol.Envelope
+	json.Unmarshal(data, &errEnv)
+	if errEnv.Type != protocol.TypeChatError {
+		t.Fatalf("expected chat.error, got %s", errEnv.Type)
+	}
+}
+
+func TestVersionNegotiationAndTranslation(t *testing.T) {
+	store := newMockStore()
+	h := NewHub(store)
+	token, _ := h.CreateToken()
+
+	auth := func(role string, v int, versions ...int) (*Session, *Connection, error) {
+		payload, _ := json.Marshal(protocol.AuthPayload{Token: token, Role: role, Versions: versions})
+		conn := NewConnection(nil, "", nil)
+		session, err := h.Authenticate(conn, &protocol.Envelope{V: v, Type: protocol.TypeAuth, Payload: payload})
+		return session, conn, err
+	}
+
+	if _, _, err := auth("phone", 1, 3, 4); !errors.Is(err, ErrUnsupportedVersion) {
+		t.Fatalf("expected ErrUnsupportedVersion, got %v", err)
+	}
+	if _, _, err := auth("phone", 7); !errors.Is(err, ErrUnsupportedVersion) {
+		t.Fatalf("expected ErrUnsupportedVersion for an unknown envelope version, got %v", err)
+	}
+
+	session, phone, err := auth("phone", 1, 1, 2)
+	if err != nil {
+		t.Fatalf("Authenticate failed: %v", err)
+	}
+	if ok := h.AuthOk(session, phone); ok.Version != 2 {
+		t.Fatalf("expected version 2 in auth.ok, got %d", ok.Version)
+	}
+	_, agent, err := auth("agent", 0)
+	if err != nil || agent.Version != 1 {
+		t.Fatalf("expected legacy agent on version 1, got %d (%v)", agent.Version, err)
+	}
+
+	// A version 2 phone message reaches the version 1 agent flattened.
+	in := []byte(`{"v":2,"type":"chat.send","id":"m1","ts":1,"meta":{"ttl_ms":60000},"payload":{"text":"hi"}}`)
+	raw, err := phone.Decode(in, false)
+	if err != nil {
+		t.Fatalf("Decode failed: %v", err)
+	}
+	var env protocol.Envelope
+	json.Unmarshal(raw, &env)
+	h.ForwardMessage(session, phone, &env, raw)
+	got := recvEnvelope(t, agent)
+	if got.V != 1 || got.TTLMs != 60000 || got.Device != phone.DeviceID {
+		t.Fatalf("expected a flat version 1 envelope, got %+v", got)
+	}
+
+	// The agent's answer reaches the phone with routing fields under meta.
+	reply, _ := protocol.NewEnvelope(protocol.TypeChatHistoryResult, map[string]interface{}{"messages": []string{}})
+	reply.ReplyTo = "m1"
+	replyRaw, _ := reply.Marshal()
+	h.ForwardMessage(session, agent, reply, replyRaw)
+	frame, _ := phone.Next()
+	var out map[string]json.RawMessage
+	json.Unmarshal(phone.Encode(frame).Data, &out)
+	var meta struct {
+		ReplyTo string `json:"reply_to"`
+		RSeq    uint64 `json:"rseq"`
+	}
+	json.Unmarshal(out["meta"], &meta)
+	if string(out["v"]) != "2" || meta.ReplyTo != "m1" || meta.RSeq == 0 || out["reply_to"] != nil {
+		t.Fatalf("expected a version 2 envelope, got %s", phone.Encode(frame).Data)
+	}
+}
+
+func TestStrictPayloads(t *testing.T) {
+	tests := []struct {
+		name    string
+		role    string
+		msgType string
+		payload string
+		field   string // "" if the message passes
+	}{
+		{"valid send", "phone", protocol.TypeChatSend, `{"text":"hi","attachments":[{"type":"image","mime_type":"image/png","content_b64":"AA=="}]}`, ""},
+		{"missing text", "phone", protocol.TypeChatSend, `{"agent_id":"main"}`, "payload.text"},
+		{"nested field", "phone", protocol.TypeChatSend, `{"text":"hi","attachments":[{"type":"image","content_b64":"AA=="}]}`, "payload.attachments[0].mime_type"},
+		{"string seq", "agent", protocol.TypeChatStream, `{"delta":"a","seq":"1"}`, "payload.seq"},
+		{"fractional seq", "agent", protocol.TypeChatStream, `{"delta":"a","seq":1.5}`, "payload.seq"},
+		{"unknown fields allowed", "agent", protocol.TypeChatStream, `{"delta":"a","seq":1,"extra":true}`, ""},
+		{"not an object", "agent", protocol.TypeChatDone, `"done"`, "payload"},
+		{"encrypted", "agent", protocol.TypeChatStream, `{"enc":true,"ciphertext":"x","nonce":"y"}`, ""},
+		{"no struct", "phone", protocol.TypeMemorySearch, `{"anything":1}`, ""},
+	}
+
+	for _, strict := range []bool{true, false} {
+		store := newMockStore()
+		h := NewHubWithConfig(store, Config{StrictPayloads: strict})
+		token, _ := h.CreateToken()
+		_, agent := authConn(t, h, token, "agent", "")
+		session, phone := authConn(t, h, token, "phone", "")
+
+		for _, tt := range tests {
+			sender, peer := phone, agent
+			if tt.role == "agent" {
+				sender, peer = agent, phone
+			}
+			env := &protocol.Envelope{V: 1, Type: tt.msgType, ID: "m", Payload: json.RawMessage(tt.payload)}
+			raw, _ := env.Marshal()
+			h.ForwardMessage(session, sender, env, raw)
+
+			if tt.field == "" || !strict {
+				if got := recvEnvelope(t, peer); got.Type != tt.msgType {
+					t.Fatalf("%s (strict=%v): expected %s forwarded, got %s", tt.name, strict, tt.msgType, got.Type)
+				}
+				continue
+			}
+			var p protocol.ErrorPayload
+			got := recvEnvelope(t, sender)
+			got.ParsePayload(&p)
+			if p.Code != protocol.ErrInvalidMessage || p.Field != tt.field || peer.Pending() != 0 {
+				t.Fatalf("%s: expected INVALID_MESSAGE for %s, got %+v", tt.name, tt.field, p)
+			}
+		}
+	}
+}
+
+func TestStrictRejectsSpendNoRate(t *testing.T) {
+	store := newMockStore()
+	h := NewHubWithConfig(store, Config{StrictPayloads: true})
+	token, _ := h.CreateToken()
+	_, agent := authConn(t, h, token, "agent", "")
+	session, phone := authConn(t, h, token, "phone", "")
+	phone.Limiter = rate.NewLimiter(0, 1)
+
+	for _, payload := range []string{`{"agent_id":"main"}`, `{"text":1}`, `{"text":"hi"}`} {
+		env := &protocol.Envelope{V: 1, Type: protocol.TypeChatSend, ID: "m", Payload: json.RawMessage(payload)}
+		raw, _ := env.Marshal()
+		h.ForwardMessage(session, phone, env, raw)
+	}
+	if got := recvEnvelope(t, agent); got.Type != protocol.TypeChatSend {
+		t.Fatalf("expected the valid message within the rate limit, got %s", got.Type)
+	}
+}
+
+func TestFileTransfer(t *testing.T) {
+	store := newMockStore()
+	h := NewHubWithConfig(store, Config{MaxFileSize: 16})
+	token, _ := h.CreateToken()
+	_, agent := authConn(t, h, token, "agent", "")
+	session, phone := authConn(t, h, token, "phone", "")
+
+	file := []byte("hello, relay!")
+	sum := sha256.Sum256(file)
+	digest := hex.EncodeToString(sum[:])
+
+	send := func(sender *Connection, msgType string, payload interface{}) {
+		t.Helper()
+		env, _ := protocol.NewEnvelope(msgType, payload)
+		raw, _ := env.Marshal()
+		h.ForwardMessage(session, sender, env, raw)
+	}
+	chunk := func(offset, end int) protocol.FileChunkPayload {
+		part := sha256.Sum256(file[offset:end])
+		return protocol.FileChunkPayload{TransferID: "f1", Offset: int64(offset),
+			DataB64: base64.StdEncoding.EncodeToString(file[offset:end]), SHA256: hex.EncodeToString(part[:])}
+	}
+	forwarded := func(to *Connection, msgType string) {
+		t.Helper()
+		if got := recvEnvelope(t, to); got.Type != msgType {
+			t.Fatalf("expected %s forwarded, got %s", msgType, got.Type)
+		}
+	}
+	rejected := func(from *Connection, code string) {
+		t.Helper()
+		var p protocol.ErrorPayload
+		got := recvEnvelope(t, from)
+		got.ParsePayload(&p)
+		if got.Type != protocol.TypeChatError || p.Code != code {
+			t.Fatalf("expected %s, got %s %+v", code, got.Type, p)
+		}
+		if agent.Pending()+phone.Pending() != 0 {
+			t.Fatal("rejected message must not be forwarded")
+		}
+	}
+
+	send(phone, protocol.TypeFileOffer, protocol.FileOfferPayload{TransferID: "big", Size: 17, SHA256: digest})
+	rejected(phone, protocol.ErrFileTooLarge)
+
+	offer := protocol.FileOfferPayload{TransferID: "f1", Name: "a.txt", Size: int64(len(file)), SHA256: digest}
+	send(phone, protocol.TypeFileOffer, offer)
+	forwarded(agent, protocol.TypeFileOffer)
+	send(phone, protocol.TypeFileChunk, chunk(0, 5))
+	rejected(phone, protocol.ErrInvalidMessage) // not accepted yet
+
+	send(agent, protocol.TypeFileAccept, protocol.FileAcceptPayload{TransferID: "f1"})
+	forwarded(phone, protocol.TypeFileAccept)
+	send(phone, protocol.TypeFileChunk, chunk(0, 5))
+	forwarded(agent, protocol.TypeFileChunk)
+	send(phone, protocol.TypeFileChunk, chunk(8, 10))
+	rejected(phone, protocol.ErrInvalidMessage) // gap
+	bad := chunk(5, 8)
+	bad.SHA256 = digest
+	send(phone, protocol.TypeFileChunk, bad)
+	rejected(phone, protocol.ErrInvalidMessage) // hash mismatch
+	send(agent, protocol.TypeFileAck, protocol.FileAckPayload{TransferID: "f1", Offset: 5})
+	forwarded(phone, protocol.TypeFileAck)
+	send(phone, protocol.TypeFileComplete, protocol.FileCompletePayload{TransferID: "f1"})
+	rejected(phone, protocol.ErrInvalidMessage) // incomplete
+
+	// A reconnecting client learns where to resume.
+	progress := h.AuthOk(session, phone).Transfers
+	if len(progress) != 1 || progress[0].Direction != "send" || progress[0].Offset != 5 {
+		t.Fatalf("unexpected sender progress: %+v", progress)
+	}
+	if progress := h.AuthOk(session, agent).Transfers; len(progress) != 1 || progress[0].Direction != "receive" {
+		t.Fatalf("unexpected receiver progress: %+v", progress)
+	}
+
+	other := offer
+	other.Size = 3
+	send(phone, protocol.TypeFileOffer, other)
+	rejected(phone, protocol.ErrInvalidMessage) // transfer ID reused for another file
+	send(phone, protocol.TypeFileOffer, offer)
+	forwarded(agent, protocol.TypeFileOffer)
+	send(agent, protocol.TypeFileAccept, protocol.FileAcceptPayload{TransferID: "f1", Offset: 5})
+	forwarded(phone, protocol.TypeFileAccept)
+	send(phone, protocol.TypeFileChunk, chunk(5, len(file)))
+	forwarded(agent, protocol.TypeFileChunk)
+	send(phone, protocol.TypeFileComplete, protocol.FileCompletePayload{TransferID: "f1"})
+	forwarded(agent, protocol.TypeFileComplete)
+	if progress := h.AuthOk(session, phone).Transfers; len(progress) != 0 {
+		t.Fatalf("completed transfer should be forgotten, got %+v", progress)
+	}
+	if usage, _ := store.GetDailyUsage(token); usage == 0 {
+		t.Fatal("file traffic should count against quota")
+	}
+
+	// Offers larger than the remaining quota are refused up front, apart from
+	// a quota already used up.
+	used, _ := store.GetDailyUsage(token)
+	store.RecordBytes(token, ratelimit.DailyQuotaBytes-used-10)
+	offer.TransferID = "f2"
+	send(phone, protocol.TypeFileOffer, offer)
+	rejected(phone, protocol.ErrFileExceedsQuota)
+	store.RecordBytes(token, 10)
+	send(phone, protocol.TypeFileOffer, offer)
+	rejected(phone, protocol.ErrDailyQuotaExceeded)
+}
+
+func TestMeterWireBytes(t *testing.T) {
+	text := strings.Repeat("stream me ", 400)
+	for _, wire := range []bool{false, true} {
+		store := newMockStore()
+		h := NewHubWithConfig(store, Config{MeterWireBytes: wire})
+		token, _ := h.CreateToken()
+		_, agent := authConn(t, h, token, "agent", "")
+		agent.Deflate = &Compression{Level: 6, Threshold: 64}
+		session, phone := authConn(t, h, token, "phone", "")
+
+		env, _ := protocol.NewEnvelope(protocol.TypeChatSend, protocol.ChatSendPayload{Text: text})
+		raw, _ := env.Marshal()
+		h.ForwardMessage(session, phone, env, raw)
+		frame, _ := agent.Next()
+
+		usage, _ := store.GetDailyUsage(token)
+		if !wire && usage != int64(len(frame.Data)) {
+			t.Fatalf("expected raw length %d metered, got %d", len(frame.Data), usage)
+		}
+		if wire && (usage != agent.WireSize(frame) || usage*10 > int64(len(frame.Data))) {
+			t.Fatalf("expected compressed size metered, got %d for %d bytes", usage, len(frame.Data))
+		}
+	}
+
+	conn := NewConnection(nil, "", nil)
+	conn.Deflate = &Compression{Level: 1, Threshold: 64}
+	small := Frame{Data: []byte(`{"type":"pong"}`)}
+	if conn.Compresses(len(small.Data)) || conn.WireSize(small) != int64(len(small.Data)) {
+		t.Fatal("frames under the threshold are sent as they are")
+	}
+}
@@ -0,0 +1,141 @@
+package hub
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"github.com/openclaw/openclaw-relay/internal/protocol"
+	"github.com/openclaw/openclaw-relay/internal/ratelimit"
+)
+
+// ErrDrop is returned by an interceptor to discard a message without telling
+// the sender.
+var ErrDrop = errors.New("message dropped")
+
+// Rejection is returned by an interceptor to refuse a message; the sender
+// gets the payload as a chat.error.
+type Rejection struct {
+	protocol.ErrorPayload
+}
+
+// Reject builds a Rejection.
+func Reject(code, message string, retryMs int64) *Rejection {
+	return &Rejection{protocol.ErrorPayload{Code: code, Message: message, RetryAfterMs: retryMs}}
+}
+
+func (r *Rejection) Error() string {
+	return r.Code + ": " + r.Message
+}
+
+// Message is a message on its way through the forwarding chain.
+type Message struct {
+	Session *Session
+	Sender  *Connection
+	Env     *protocol.Envelope
+	Raw     []byte         // JSON frame as it will be forwarded
+	Size    int            // size of the frame as received, which may not be JSON
+	Route   protocol.Route // set by RouteCheck
+	// Received is when the relay received the message; ttl_ms counts
+	// from here.
+	Received time.Time
+
+	hub *Hub
+}
+
+// SetEnvelope replaces the message with env, re-encoding the forwarded frame.
+func (m *Message) SetEnvelope(env *protocol.Envelope) error {
+	raw, err := env.Marshal()
+	if err != nil {
+		return err
+	}
+	m.Env, m.Raw = env, raw
+	return nil
+}
+
+// Handler processes a message at one point of the forwarding chain.
+type Handler func(m *Message) error
+
+// Interceptor is a link of the forwarding chain. It passes the message on by
+// calling next, optionally after modifying it, drops it by returning ErrDrop
+// or refuses it by returning a *Rejection.
+type Interceptor func(m *Message, next Handler) error
+
+// DefaultInterceptors returns the built-in links in their default order.
+func DefaultInterceptors() []Interceptor {
+	return []Interceptor{SizeCheck, RouteCheck, SchemaCheck, RateCheck, QuotaCheck, FileCheck}
+}
+
+// SizeCheck refuses messages over the relay's size limit.
+func SizeCheck(m *Message, next Handler) error {
+	if m.Size > ratelimit.MaxMessageSize {
+		return Reject(protocol.ErrMessageTooLarge, "Message exceeds 5MB limit", 0)
+	}
+	return next(m)
+}
+
+// RouteCheck resolves the message's route, refusing types the sender may not
+// send.
+func RouteCheck(m *Message, next Handler) error {
+	route, err := m.hub.Route(m.Sender.Role, m.Env.Type)
+	if err != nil {
+		return Reject(protocol.ErrInvalidMessage, err.Error(), 0)
+	}
+	m.Route = route
+	return next(m)
+}
+
+// RateCheck applies the sender's per-connection rate limit to metered messages.
+func RateCheck(m *Message, next Handler) error {
+	if m.Route.Metered && m.Sender.Limiter != nil && !m.Sender.Limiter.Allow() {
+		return Reject(protocol.ErrRateLimited, "Rate limit exceeded", 1000)
+	}
+	return next(m)
+}
+
+// QuotaCheck refuses metered messages once the token's bandwidth quota is used up.
+func QuotaCheck(m *Message, next Handler) error {
+	if !m.Route.Metered {
+		return next(m)
+	}
+	code, err := m.hub.quotaChecker.Check(m.Session.Token)
+	if err != nil {
+		log.Printf("quota check error for %s: %v", m.Session.Token, err)
+	}
+	if code != "" {
+		return Reject(code, "Bandwidth quota exceeded", 60000)
+	}
+	return next(m)
+}
+
+// SchemaCheck refuses unencrypted payloads that do not match their type's
+// struct, if Config.StrictPayloads is set.
+func SchemaCheck(m *Message, next Handler) error {
+	if !m.hub.config.StrictPayloads {
+		return next(m)
+	}
+	if err := protocol.ValidatePayload(m.Env); err != nil {
+		rej := Reject(protocol.ErrInvalidMessage, err.Error(), 0)
+		var verr *protocol.ValidationError
+		if errors.As(err, &verr) {
+			rej.Field = verr.Field
+		}
+		return rej
+	}
+	return next(m)
+}
+
+// chain builds the forwarding chain from the configured interceptors, ending
+// in send.
+func (h *Hub) chain() Handler {
+	links := h.config.Interceptors
+	if links == nil {
+		links = DefaultInterceptors()
+	}
+	handler := h.send
+	for i := len(links) - 1; i >= 0; i-- {
+		link, next := links[i], handler
+		handler = func(m *Message) error { return link(m, next) }
+	}
+	return handler
+}
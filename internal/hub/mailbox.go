@@ -0,0 +1,192 @@
+package hub
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/openclaw/openclaw-relay/internal/protocol"
+	"github.com/openclaw/openclaw-relay/internal/store"
+)
+
+// Default offline queue limits, used when the config leaves them unset.
+const (
+	DefaultQueueMaxMessages       = 500
+	DefaultQueueMaxBytes    int64 = 20 * 1024 * 1024 // 20 MB
+	DefaultQueueTTL               = 24 * time.Hour
+)
+
+// OfflineQueue configures store-and-forward delivery to disconnected peers.
+// Queueing is disabled while Mailbox is nil.
+type OfflineQueue struct {
+	Mailbox     store.Mailbox
+	MaxMessages int           // per token and role, counting each device's copy
+	MaxBytes    int64         // per token and role, counting each device's copy
+	TTL         time.Duration // queued messages older than this are dropped
+}
+
+func (q OfflineQueue) maxMessages() int {
+	if q.MaxMessages > 0 {
+		return q.MaxMessages
+	}
+	return DefaultQueueMaxMessages
+}
+
+func (q OfflineQueue) maxBytes() int64 {
+	if q.MaxBytes > 0 {
+		return q.MaxBytes
+	}
+	return DefaultQueueMaxBytes
+}
+
+func (q OfflineQueue) ttl() time.Duration {
+	if q.TTL > 0 {
+		return q.TTL
+	}
+	return DefaultQueueTTL
+}
+
+// enqueueForPeer stores a message for the offline peer role. A message for
+// phones is stored for the device the envelope names or else once for every
+// phone device the session has seen, so each gets it when it comes back.
+// Messages for agents, and for phones before any was seen, are stored once
+// for whichever device connects first. It returns false if queueing is
+// disabled or the peer's mailbox is full. Callers hold session.queueMu.
+func (h *Hub) enqueueForPeer(session *Session, role string, env *protocol.Envelope, raw []byte) bool {
+	q := h.config.OfflineQueue
+	if q.Mailbox == nil {
+		return false
+	}
+	devices := []string{""}
+	if role == protocol.RolePhone {
+		if env.Device != "" {
+			devices = []string{env.Device}
+		} else if known := session.Presence(role); len(known) > 0 {
+			devices = devices[:0]
+			for _, p := range known {
+				devices = append(devices, p.Device)
+			}
+		}
+	}
+
+	count, bytes, err := q.Mailbox.MailboxUsage(session.Token, role)
+	if err != nil {
+		log.Printf("mailbox usage error for %s: %v", session.Token, err)
+		return false
+	}
+	if count+len(devices) > q.maxMessages() || bytes+int64(len(devices)*len(raw)) > q.maxBytes() {
+		return false
+	}
+	for _, device := range devices {
+		if err := q.Mailbox.Enqueue(session.Token, role, device, raw); err != nil {
+			log.Printf("mailbox enqueue error for %s: %v", session.Token, err)
+			return false
+		}
+	}
+	return true
+}
+
+// takeQueued removes the messages queued for conn's device from the mailbox
+// and stamps them with relay sequence numbers for it, keeping them on conn for
+// DeliverQueued. From then on the replay buffer holds them like any frame sent
+// to the device. Callers hold session.queueMu, so two devices cannot take the
+// same entry.
+func (h *Hub) takeQueued(session *Session, conn *Connection) {
+	q := h.config.OfflineQueue
+	if q.Mailbox == nil {
+		return
+	}
+	msgs, err := q.Mailbox.Pending(session.Token, conn.Role, conn.DeviceID, time.Now().Add(-q.ttl()))
+	if err != nil {
+		log.Printf("mailbox read error for %s: %v", session.Token, err)
+		return
+	}
+
+	for _, m := range msgs {
+		if err := q.Mailbox.Remove(m.ID); err != nil {
+			// Left for a later connection rather than risk sending it twice
+			log.Printf("mailbox remove error: %v", err)
+			continue
+		}
+		var env protocol.Envelope
+		if err := json.Unmarshal(m.Data, &env); err != nil {
+			log.Printf("mailbox entry %d unreadable, dropping: %v", m.ID, err)
+			continue
+		}
+		// Phone messages are tagged with their sender's device; in agent
+		// messages device names the recipient, so every agent is told
+		sender := env.Device
+		if conn.Role == protocol.RolePhone {
+			sender = ""
+		}
+		expires, onExpired := h.expiry(session, peerRole(conn.Role), sender, &env, m.CreatedAt)
+		frame := Frame{Data: m.Data, Expires: expires, OnExpired: onExpired}
+		if expires.IsZero() || time.Now().Before(expires) {
+			data, err := h.sequence(session, []*Connection{conn}, m.Data, expires)
+			if err != nil {
+				log.Printf("mailbox sequence error: %v", err)
+			} else {
+				frame.Data = data
+			}
+		}
+		conn.queued = append(conn.queued, frame)
+	}
+}
+
+// DeliverQueued sends the messages conn took from the mailbox when it
+// authenticated, in the order they were queued, and then whatever was
+// forwarded to it meanwhile, which waits until they are sent. It blocks while
+// the connection's send buffer is full, so the write pump must already be
+// running. Each message counts against quota once it is handed to the
+// connection; one that expired meanwhile is reported to its sender instead.
+func (h *Hub) DeliverQueued(session *Session, conn *Connection) {
+	queued := conn.queued
+	conn.queued = nil
+	defer conn.release()
+
+	delivered := 0
+	for _, f := range queued {
+		if !f.Expires.IsZero() && !time.Now().Before(f.Expires) {
+			f.OnExpired()
+			continue
+		}
+		frame := conn.Encode(f)
+		frame.backlog = true
+		if !conn.EnqueueWait(frame, 0) {
+			log.Printf("mailbox replay interrupted: token=%s role=%s remaining=%d", session.Token[:min(16, len(session.Token))]+"...", conn.Role, len(queued)-delivered)
+			return
+		}
+		if err := h.quotaChecker.Record(session.Token, h.frameSize(conn, frame)); err != nil {
+			log.Printf("quota record error: %v", err)
+		}
+		conn.BytesRecv.Add(int64(len(frame.Data)))
+		delivered++
+	}
+	if delivered > 0 {
+		log.Printf("mailbox replayed %d messages: token=%s role=%s", delivered, session.Token[:min(16, len(session.Token))]+"...", conn.Role)
+	}
+}
+
+// purgeMailbox drops queued messages that outlived the TTL.
+func (h *Hub) purgeMailbox() {
+	q := h.config.OfflineQueue
+	if q.Mailbox == nil {
+		return
+	}
+	n, err := q.Mailbox.PurgeExpired(time.Now().Add(-q.ttl()))
+	if err != nil {
+		log.Printf("mailbox purge error: %v", err)
+		return
+	}
+	if n > 0 {
+		log.Printf("purged %d expired queued messages", n)
+	}
+}
+
+// peerRole returns the role on the other side of the pairing.
+func peerRole(role string) string {
+	if role == protocol.RolePhone {
+		return protocol.RoleAgent
+	}
+	return protocol.RolePhone
+}
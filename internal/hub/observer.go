@@ -0,0 +1,102 @@
+package hub
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/openclaw/openclaw-relay/internal/protocol"
+)
+
+// EventKind identifies what an Event reports.
+type EventKind int
+
+const (
+	EventAuth          EventKind = iota + 1 // a connection authenticated
+	EventAuthFailed                         // an auth attempt was refused; Err says why
+	EventPaired                             // a session gained its first phone/agent pair
+	EventUnpaired                           // a session lost its last phone or agent
+	EventReplaced                           // a connection was evicted by a newer one
+	EventDisconnect                         // a connection closed
+	EventForward                            // a message was delivered to Peers connections
+	EventQueued                             // a message was stored for an offline peer
+	EventRejected                           // a message was refused with Code
+	EventQuotaExceeded                      // a message was refused by the bandwidth quota
+	EventIdleCleanup                        // an idle session was removed
+	EventDropped                            // an interceptor discarded a message
+	EventExpired                            // a message outlived its ttl_ms undelivered
+)
+
+var eventNames = map[EventKind]string{
+	EventAuth:          "auth",
+	EventAuthFailed:    "auth_failed",
+	EventPaired:        "paired",
+	EventUnpaired:      "unpaired",
+	EventReplaced:      "replaced",
+	EventDisconnect:    "disconnect",
+	EventForward:       "forward",
+	EventQueued:        "queued",
+	EventRejected:      "rejected",
+	EventDropped:       "dropped",
+	EventExpired:       "expired",
+	EventQuotaExceeded: "quota_exceeded",
+	EventIdleCleanup:   "idle_cleanup",
+}
+
+func (k EventKind) String() string {
+	if name, ok := eventNames[k]; ok {
+		return name
+	}
+	return "event(" + strconv.Itoa(int(k)) + ")"
+}
+
+// Event describes something the hub did. Fields that do not apply to Kind
+// are left zero.
+type Event struct {
+	Kind   EventKind
+	Time   time.Time
+	Token  string
+	Role   string // role of the connection the event is about
+	Device string
+	Type   string // message type, for message events
+	Bytes  int64  // message size, for message events
+	Peers  int    // connections a forwarded message reached
+	Code   string // protocol error code, for rejections
+	Err    error  // cause of an auth failure
+}
+
+// Observer receives hub events. Observe is called synchronously from the
+// goroutine that caused the event, so it must return quickly; hand events to
+// a queue for anything slow.
+type Observer interface {
+	Observe(Event)
+}
+
+// ObserverFunc adapts an ordinary function to the Observer interface.
+type ObserverFunc func(Event)
+
+// Observe calls f(e).
+func (f ObserverFunc) Observe(e Event) { f(e) }
+
+// emit stamps an event and hands it to every configured observer.
+func (h *Hub) emit(e Event) {
+	if len(h.config.Observers) == 0 {
+		return
+	}
+	e.Time = time.Now()
+	for _, o := range h.config.Observers {
+		o.Observe(e)
+	}
+}
+
+// connEvent returns an event of kind about conn in session.
+func connEvent(kind EventKind, session *Session, conn *Connection) Event {
+	return Event{Kind: kind, Token: session.Token, Role: conn.Role, Device: conn.DeviceID}
+}
+
+// messageEvent returns an event of kind about a message sender sent.
+func messageEvent(kind EventKind, session *Session, sender *Connection, env *protocol.Envelope, size int) Event {
+	e := connEvent(kind, session, sender)
+	e.Type = env.Type
+	e.Bytes = int64(size)
+	return e
+}
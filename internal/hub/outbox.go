@@ -0,0 +1,248 @@
+package hub
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Queue sizes per lane. Sends to a full lane fail (or block, for callers that
+// wait for space).
+const (
+	SendQueueSize    = 256
+	ControlQueueSize = 64
+)
+
+// Lane selects which of a connection's outbound queues a frame uses. The write
+// pump always drains the control lane before the bulk lane.
+type Lane int
+
+const (
+	LaneBulk    Lane = iota // forwarded peer traffic
+	LaneControl             // relay-generated status, errors, receipts and pongs
+	numLanes
+)
+
+func (l Lane) String() string {
+	if l == LaneControl {
+		return "control"
+	}
+	return "bulk"
+}
+
+func (l Lane) size() int {
+	if l == LaneControl {
+		return ControlQueueSize
+	}
+	return SendQueueSize
+}
+
+// Frame is an outbound message queued on a connection.
+type Frame struct {
+	Data   []byte
+	Lane   Lane
+	Binary bool // Data is CBOR, for a binary connection
+	// OnWritten, if set, is called by the write pump once the frame has
+	// been written to the socket.
+	OnWritten func()
+	// Expires, if set, is when the frame becomes worthless. Expired frames
+	// are discarded instead of written, calling OnExpired.
+	Expires   time.Time
+	OnExpired func()
+
+	stream  string // coalescing key for chat.stream frames
+	encoded bool   // Data is in the connection's version and encoding
+	backlog bool   // catch-up frame, queued ahead of held live frames
+}
+
+// laneDrops counts frames dropped because their lane was full.
+type laneDrops [numLanes]atomic.Int64
+
+// outbox holds a connection's bounded FIFO per lane. Unlike a channel, the
+// frame at the tail of the bulk lane can still be rewritten until the write
+// pump takes it. While a connection catches up on what it missed, live bulk
+// frames are held back, in a queue of the same size, behind the backlog.
+type outbox struct {
+	mu      sync.Mutex
+	lanes   [numLanes][]Frame
+	held    []Frame // live bulk frames waiting for the backlog
+	holding bool
+	ready   chan struct{} // signalled when frames are added
+	space   chan struct{} // closed when bulk frames are removed, if anyone waits
+	drops   laneDrops
+	totals  *laneDrops // hub-wide counters, if attached
+}
+
+func newOutbox() outbox {
+	return outbox{ready: make(chan struct{}, 1)}
+}
+
+// push appends f to its lane if there is room. Otherwise it returns a channel
+// that is closed once the write pump frees a bulk slot.
+func (o *outbox) push(f Frame) (bool, <-chan struct{}) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	q := o.queue(f)
+	if len(*q) >= f.Lane.size() {
+		if o.space == nil {
+			o.space = make(chan struct{})
+		}
+		return false, o.space
+	}
+	*q = append(*q, f)
+	select {
+	case o.ready <- struct{}{}:
+	default:
+	}
+	return true, nil
+}
+
+// queue returns the queue f goes to. Callers must hold o.mu.
+func (o *outbox) queue(f Frame) *[]Frame {
+	if o.holding && f.Lane == LaneBulk && !f.backlog {
+		return &o.held
+	}
+	return &o.lanes[f.Lane]
+}
+
+// hold makes live bulk frames wait until release, so the backlog of a
+// connection that is catching up goes out first.
+func (c *Connection) hold() {
+	c.out.mu.Lock()
+	defer c.out.mu.Unlock()
+	c.out.holding = true
+}
+
+// release queues the held frames behind the backlog and stops holding.
+func (c *Connection) release() {
+	o := &c.out
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if !o.holding {
+		return
+	}
+	o.holding = false
+	o.lanes[LaneBulk] = append(o.lanes[LaneBulk], o.held...)
+	o.held = nil
+	select {
+	case o.ready <- struct{}{}:
+	default:
+	}
+	if o.space != nil {
+		close(o.space)
+		o.space = nil
+	}
+}
+
+// Enqueue queues a frame without blocking. It returns false, and counts a
+// drop for the frame's lane, if that lane is full.
+func (c *Connection) Enqueue(f Frame) bool {
+	ok, _ := c.out.push(f)
+	if !ok {
+		c.out.dropped(f.Lane)
+	}
+	return ok
+}
+
+func (o *outbox) dropped(l Lane) {
+	o.drops[l].Add(1)
+	if o.totals != nil {
+		o.totals[l].Add(1)
+	}
+}
+
+// Drops returns how many frames were dropped from a lane because it was full.
+func (c *Connection) Drops(l Lane) int64 {
+	return c.out.drops[l].Load()
+}
+
+// EnqueueWait queues a bulk frame, waiting for space while the lane is full.
+// It gives up when the connection closes or, if timeout is positive, once the
+// timeout elapses.
+func (c *Connection) EnqueueWait(f Frame, timeout time.Duration) bool {
+	f.Lane = LaneBulk
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	for {
+		ok, space := c.out.push(f)
+		if ok {
+			return true
+		}
+		select {
+		case <-space:
+		case <-c.Done:
+			return false
+		case <-expired:
+			c.out.dropped(f.Lane)
+			return false
+		}
+	}
+}
+
+// EnqueueMerge queues a bulk frame, but once at least watermark bulk frames
+// are waiting it first offers the frame to merge together with the queued
+// tail. If merge folds the frame into the tail, nothing new is queued.
+func (c *Connection) EnqueueMerge(f Frame, watermark int, merge func(tail *Frame) bool) bool {
+	f.Lane = LaneBulk
+	o := &c.out
+	o.mu.Lock()
+	bulk := *o.queue(f)
+	if n := len(bulk); n > 0 && n >= watermark && merge(&bulk[n-1]) {
+		o.mu.Unlock()
+		return true
+	}
+	o.mu.Unlock()
+	return c.Enqueue(f)
+}
+
+// Next removes and returns the oldest queued frame, control lane first.
+// Expired frames are discarded on the way.
+func (c *Connection) Next() (Frame, bool) {
+	for {
+		f, ok := c.next()
+		if !ok || f.Expires.IsZero() || time.Now().Before(f.Expires) {
+			return f, ok
+		}
+		if f.OnExpired != nil {
+			f.OnExpired()
+		}
+	}
+}
+
+func (c *Connection) next() (Frame, bool) {
+	o := &c.out
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for l := numLanes - 1; l >= 0; l-- {
+		q := o.lanes[l]
+		if len(q) == 0 {
+			continue
+		}
+		f := q[0]
+		q[0] = Frame{}
+		o.lanes[l] = q[1:]
+		if l == LaneBulk && o.space != nil {
+			close(o.space)
+			o.space = nil
+		}
+		return f, true
+	}
+	return Frame{}, false
+}
+
+// Ready is signalled whenever frames are queued.
+func (c *Connection) Ready() <-chan struct{} {
+	return c.out.ready
+}
+
+// Pending returns the number of queued frames across both lanes, including
+// held ones.
+func (c *Connection) Pending() int {
+	c.out.mu.Lock()
+	defer c.out.mu.Unlock()
+	return len(c.out.lanes[LaneBulk]) + len(c.out.lanes[LaneControl]) + len(c.out.held)
+}
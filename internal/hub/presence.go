@@ -0,0 +1,96 @@
+package hub
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/openclaw/openclaw-relay/internal/protocol"
+)
+
+// updatePresence applies change to the cached presence of a role's device.
+func (s *Session) updatePresence(role, device string, change func(p *protocol.Presence)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.presence == nil {
+		s.presence = make(map[string]map[string]protocol.Presence)
+	}
+	devices := s.presence[role]
+	if devices == nil {
+		devices = make(map[string]protocol.Presence)
+		s.presence[role] = devices
+	}
+	p := devices[device]
+	change(&p)
+	p.Device = device
+	p.LastSeen = time.Now().UnixMilli()
+	devices[device] = p
+}
+
+// Presence returns the last known presence of every device of a role,
+// including devices that have gone offline, ordered by device ID.
+func (s *Session) Presence(role string) []protocol.Presence {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	devices := s.presence[role]
+	if len(devices) == 0 {
+		return nil
+	}
+	list := make([]protocol.Presence, 0, len(devices))
+	for _, p := range devices {
+		list = append(list, p)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Device < list[j].Device })
+	return list
+}
+
+// SetPresence handles presence.set: it records the sender's new state and
+// reports it to the sender's peers.
+func (h *Hub) SetPresence(session *Session, conn *Connection, env *protocol.Envelope) error {
+	var set protocol.PresenceSetPayload
+	if err := env.ParsePayload(&set); err != nil {
+		return h.sendError(conn, protocol.ErrInvalidMessage, "Invalid presence payload", 0)
+	}
+	switch set.State {
+	case protocol.PresenceAvailable, protocol.PresenceBusy, protocol.PresenceAway:
+	default:
+		return h.sendError(conn, protocol.ErrInvalidMessage, fmt.Sprintf("invalid presence state: %s", set.State), 0)
+	}
+
+	session.updatePresence(conn.Role, conn.DeviceID, func(p *protocol.Presence) {
+		p.State = set.State
+	})
+	for _, peer := range session.PeerConns(conn.Role) {
+		h.sendStatus(session, peer, conn)
+	}
+	log.Printf("presence: token=%s role=%s device=%s state=%s", session.Token[:min(16, len(session.Token))]+"...", conn.Role, conn.DeviceID, set.State)
+	return nil
+}
+
+// sendStatus reports the presence of subject's role to one of its peers,
+// naming subject as the device that changed.
+func (h *Hub) sendStatus(session *Session, peer, subject *Connection) {
+	status := protocol.StatusPayload{
+		Peer:    protocol.StatusOffline,
+		Device:  subject.DeviceID,
+		Devices: session.Presence(subject.Role),
+	}
+	for _, p := range status.Devices {
+		if p.Status == protocol.StatusOnline {
+			status.Peer = protocol.StatusOnline
+		}
+	}
+
+	env, err := protocol.NewEnvelope(protocol.TypeStatus, status)
+	if err != nil {
+		log.Printf("error creating status: %v", err)
+		return
+	}
+	data, err := env.Marshal()
+	if err != nil {
+		log.Printf("error marshaling status: %v", err)
+		return
+	}
+	peer.Enqueue(Frame{Data: data, Lane: LaneControl})
+}
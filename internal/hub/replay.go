@@ -0,0 +1,185 @@
+package hub
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/openclaw/openclaw-relay/internal/protocol"
+)
+
+// Default replay buffer bounds, per session and direction.
+const (
+	DefaultReplayFrames       = 256
+	DefaultReplayBytes  int64 = 2 * 1024 * 1024 // 2 MB
+)
+
+// replayBuffer numbers the frames the relay delivers toward one role and keeps
+// the most recent ones until the devices they went to acknowledge them, so a
+// reconnecting client can ask for whatever it missed. The sequence is shared
+// by the role's devices; each frame remembers which of them it is for.
+type replayBuffer struct {
+	mu     sync.Mutex
+	seq    uint64
+	frames []replayFrame
+	bytes  int64
+}
+
+type replayFrame struct {
+	seq     uint64
+	data    []byte
+	expires time.Time // zero if the message has no TTL
+	pending []string  // devices that received it and have not acked it
+}
+
+// pendingFor reports whether device has yet to ack the frame.
+func (f *replayFrame) pendingFor(device string) bool {
+	for _, d := range f.pending {
+		if d == device {
+			return true
+		}
+	}
+	return false
+}
+
+// push assigns the next sequence number to raw, stamps it on the envelope and
+// keeps the stamped frame for devices, evicting the oldest frames beyond the
+// limits.
+func (b *replayBuffer) push(raw []byte, expires time.Time, devices []string, maxFrames int, maxBytes int64) ([]byte, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	data, err := protocol.SetField(raw, "rseq", b.seq+1)
+	if err != nil {
+		return nil, err
+	}
+	b.seq++
+	b.frames = append(b.frames, replayFrame{seq: b.seq, data: data, expires: expires, pending: devices})
+	b.bytes += int64(len(data))
+	for len(b.frames) > 0 && (len(b.frames) > maxFrames || b.bytes > maxBytes) {
+		b.bytes -= int64(len(b.frames[0].data))
+		b.frames = b.frames[1:]
+	}
+	return data, nil
+}
+
+// ack releases every frame up to and including seq for device, dropping the
+// frames no other device still waits for.
+func (b *replayBuffer) ack(device string, seq uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	kept := b.frames[:0]
+	for _, f := range b.frames {
+		if f.seq <= seq && f.pendingFor(device) {
+			var pending []string
+			for _, d := range f.pending {
+				if d != device {
+					pending = append(pending, d)
+				}
+			}
+			f.pending = pending
+		}
+		if len(f.pending) == 0 {
+			b.bytes -= int64(len(f.data))
+			continue
+		}
+		kept = append(kept, f)
+	}
+	b.frames = kept
+}
+
+// since returns the buffered frames for device after seq and whether the
+// buffer covers the whole gap, i.e. nothing after seq was evicted.
+func (b *replayBuffer) since(device string, seq uint64) ([]replayFrame, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var frames []replayFrame
+	for _, f := range b.frames {
+		if f.seq > seq && f.pendingFor(device) {
+			frames = append(frames, f)
+		}
+	}
+	complete := seq >= b.seq || (len(b.frames) > 0 && b.frames[0].seq <= seq+1)
+	return frames, complete
+}
+
+// last returns the highest sequence number assigned so far.
+func (b *replayBuffer) last() uint64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.seq
+}
+
+// sequence stamps a frame headed for the peers, all of one role, with the next
+// relay sequence number. A resumed frame is not resent once expires has
+// passed.
+func (h *Hub) sequence(session *Session, peers []*Connection, raw []byte, expires time.Time) ([]byte, error) {
+	maxFrames, maxBytes := h.config.ReplayFrames, h.config.ReplayBytes
+	if maxFrames <= 0 {
+		maxFrames = DefaultReplayFrames
+	}
+	if maxBytes <= 0 {
+		maxBytes = DefaultReplayBytes
+	}
+	devices := make([]string, len(peers))
+	for i, peer := range peers {
+		devices[i] = peer.DeviceID
+	}
+	return session.replayTo(peers[0].Role).push(raw, expires, devices, maxFrames, maxBytes)
+}
+
+// Ack releases frames the client has processed from the replay buffer.
+func (h *Hub) Ack(session *Session, conn *Connection, env *protocol.Envelope) {
+	var ack protocol.AckPayload
+	if err := env.ParsePayload(&ack); err != nil {
+		h.sendError(conn, protocol.ErrInvalidMessage, "Invalid ack payload", 0)
+		return
+	}
+	session.replayTo(conn.Role).ack(conn.DeviceID, ack.Seq)
+}
+
+// Resume resends the frames a reconnecting client missed after the last
+// sequence number it reported in auth, up to the last one sent before it
+// registered. Frames forwarded to it since wait until they are sent, and until
+// DeliverQueued if it took mailbox entries too. It blocks while the
+// connection's send buffer is full, so the write pump must already be running.
+func (h *Hub) Resume(session *Session, conn *Connection) {
+	if len(conn.queued) == 0 {
+		defer conn.release()
+	}
+	if conn.resumeSeq == 0 {
+		return
+	}
+	frames, _ := session.replayTo(conn.Role).since(conn.DeviceID, conn.resumeSeq)
+	for i, f := range frames {
+		if f.seq > conn.resumeTo {
+			// Sent live, or taken from the mailbox
+			frames = frames[:i]
+			break
+		}
+		if !conn.EnqueueWait(Frame{Data: f.data, Expires: f.expires, backlog: true}, 0) {
+			return
+		}
+	}
+	if len(frames) > 0 {
+		log.Printf("resumed %d frames: token=%s role=%s device=%s", len(frames), session.Token[:min(16, len(session.Token))]+"...", conn.Role, conn.DeviceID)
+	}
+}
+
+// AuthOk builds the auth.ok payload for a freshly authenticated connection.
+func (h *Hub) AuthOk(session *Session, conn *Connection) protocol.AuthOkPayload {
+	buf := session.replayTo(conn.Role)
+	ok := protocol.AuthOkPayload{
+		Paired:    session.IsPaired(),
+		LastSeq:   buf.last(),
+		Presence:  session.Presence(peerRole(conn.Role)),
+		DeviceID:  conn.DeviceID,
+		Encoding:  conn.Encoding,
+		Version:   conn.Version,
+		Transfers: session.Transfers(conn.Role),
+	}
+	if conn.resumeSeq > 0 {
+		_, ok.Resumed = buf.since(conn.DeviceID, conn.resumeSeq)
+	}
+	return ok
+}
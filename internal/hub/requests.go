@@ -0,0 +1,125 @@
+package hub
+
+import (
+	"log"
+	"time"
+
+	"github.com/openclaw/openclaw-relay/internal/protocol"
+)
+
+// DefaultRequestTimeout is how long the relay waits for the result of a
+// request whose route does not set its own timeout.
+const DefaultRequestTimeout = 30 * time.Second
+
+// pendingRequest is a forwarded request still waiting for its result.
+type pendingRequest struct {
+	id        string
+	result    string // message type that answers it
+	role      string // requester role and device
+	device    string
+	responder *Connection
+	timer     *time.Timer
+}
+
+// trackRequest remembers a request about to be forwarded to responder until
+// its result arrives, failing it with REQUEST_TIMEOUT once the route's timeout
+// passes. It must run before the request is queued for the responder, so an
+// answer that comes back at once finds it. It returns nil for messages that
+// expect no result.
+func (h *Hub) trackRequest(session *Session, sender, responder *Connection, env *protocol.Envelope, route protocol.Route) *pendingRequest {
+	if route.Result == "" || env.ID == "" {
+		return nil
+	}
+	timeout := time.Duration(route.TimeoutMs) * time.Millisecond
+	if timeout <= 0 {
+		timeout = h.config.RequestTimeout
+	}
+	if timeout <= 0 {
+		timeout = DefaultRequestTimeout
+	}
+
+	req := &pendingRequest{
+		id:        env.ID,
+		result:    route.Result,
+		role:      sender.Role,
+		device:    sender.DeviceID,
+		responder: responder,
+	}
+	session.reqMu.Lock()
+	defer session.reqMu.Unlock()
+	req.timer = time.AfterFunc(timeout, func() {
+		if session.takeRequest(func(r *pendingRequest) bool { return r == req }) != nil {
+			h.failRequest(session, req, protocol.ErrRequestTimeout, "Request timed out")
+		}
+	})
+	session.requests = append(session.requests, req)
+	return req
+}
+
+// untrackRequest forgets a request that could not be forwarded after all.
+func (h *Hub) untrackRequest(session *Session, req *pendingRequest) {
+	if req != nil && session.takeRequest(func(r *pendingRequest) bool { return r == req }) != nil {
+		req.timer.Stop()
+	}
+}
+
+// setResponder moves a request to the connection it was actually delivered to.
+func (s *Session) setResponder(req *pendingRequest, responder *Connection) {
+	s.reqMu.Lock()
+	defer s.reqMu.Unlock()
+	req.responder = responder
+}
+
+// completeRequest matches a message from a responder against the requests
+// waiting for it: by reply_to if set, otherwise the oldest request expecting
+// that result type.
+func (h *Hub) completeRequest(session *Session, sender *Connection, env *protocol.Envelope) {
+	req := session.takeRequest(func(r *pendingRequest) bool {
+		if r.role == sender.Role {
+			return false
+		}
+		if env.ReplyTo != "" {
+			return r.id == env.ReplyTo
+		}
+		return r.result == env.Type && (env.Device == "" || r.device == env.Device)
+	})
+	if req != nil {
+		req.timer.Stop()
+	}
+}
+
+// failRequests fails every request waiting on a responder that disconnected.
+func (h *Hub) failRequests(session *Session, responder *Connection) {
+	for {
+		req := session.takeRequest(func(r *pendingRequest) bool { return r.responder == responder })
+		if req == nil {
+			return
+		}
+		req.timer.Stop()
+		h.failRequest(session, req, protocol.ErrPeerDisconnected, "Peer disconnected before answering")
+	}
+}
+
+// failRequest tells the requester's current connection that the relay gave
+// up on a request.
+func (h *Hub) failRequest(session *Session, req *pendingRequest, code, message string) {
+	conn := session.DeviceConn(req.role, req.device)
+	if conn == nil {
+		return
+	}
+	log.Printf("request %s failed: %s", req.id, code)
+	h.sendErrorPayload(conn, protocol.ErrorPayload{Code: code, Message: message, RequestID: req.id}, req.id)
+}
+
+// takeRequest removes and returns the oldest pending request matching match.
+func (s *Session) takeRequest(match func(r *pendingRequest) bool) *pendingRequest {
+	s.reqMu.Lock()
+	defer s.reqMu.Unlock()
+	for i, r := range s.requests {
+		if match(r) {
+			s.requests = append(s.requests[:i], s.requests[i+1:]...)
+			return r
+		}
+	}
+	return nil
+}
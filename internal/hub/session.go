@@ -1,44 +1,75 @@
 package hub
 
 import (
+	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/openclaw/openclaw-relay/internal/protocol"
 	"golang.org/x/time/rate"
 )
 
 // Session represents a paired relay session identified by a pairing token.
+// A session holds any number of phone and agent connections, one per device.
 type Session struct {
-	Token     string
-	mu        sync.RWMutex
-	PhoneConn *Connection
-	AgentConn *Connection
-	LastActive atomic.Value // stores time.Time
+	Token      string
+	mu         sync.RWMutex
+	Phones     map[string]*Connection                  // keyed by device ID
+	Agents     map[string]*Connection                  // keyed by device ID
+	LastActive atomic.Value                            // stores time.Time
+	nextAgent  atomic.Uint64                           // round-robin cursor for agent selection
+	replay     map[string]*replayBuffer                // frames delivered toward each role
+	presence   map[string]map[string]protocol.Presence // by role, then device ID
+
+	// queueMu orders devices taking their mailbox entries in Authenticate
+	// (write lock) against messages being routed, queued or sequenced
+	// (read lock), so no message falls between the two.
+	queueMu sync.RWMutex
+
+	reqMu    sync.Mutex
+	requests []*pendingRequest // forwarded requests awaiting a result, oldest first
+
+	xferMu    sync.Mutex
+	transfers map[string]*transfer // unfinished file transfers by ID
 }
 
 // Connection represents a single WebSocket connection (phone or agent).
 type Connection struct {
 	WS        *websocket.Conn
 	Role      string
+	DeviceID  string
+	AgentIDs  []string     // agents served by an agent connection
+	Receipts  bool         // wants delivered receipts for forwarded messages
+	Encoding  string       // frame encoding the client reads, protocol.EncodingJSON or EncodingCBOR
+	Version   int          // negotiated protocol version
+	Deflate   *Compression // set if the connection negotiated permessage-deflate
 	Limiter   *rate.Limiter
 	BytesSent atomic.Int64
 	BytesRecv atomic.Int64
 	LastPing  time.Time
-	Send      chan []byte
 	Done      chan struct{}
+	out       outbox
 	closeOnce sync.Once
+	closeCode int // close frame sent once Done is closed, if non-zero
+	closeText string
+	resumeSeq uint64  // last relay sequence number the client reported in auth
+	resumeTo  uint64  // last relay sequence number sent before it registered
+	queued    []Frame // mailbox messages taken in auth for DeliverQueued
+
+	streamMu sync.Mutex
+	streams  map[string]openStream // open chat streams by stream_id
 }
 
-// NewConnection creates a new Connection with a send channel.
+// NewConnection creates a new Connection with an empty send queue.
 func NewConnection(ws *websocket.Conn, role string, limiter *rate.Limiter) *Connection {
 	return &Connection{
 		WS:       ws,
 		Role:     role,
 		Limiter:  limiter,
 		LastPing: time.Now(),
-		Send:     make(chan []byte, 256),
+		out:      newOutbox(),
 		Done:     make(chan struct{}),
 	}
 }
@@ -50,61 +81,102 @@ func (c *Connection) CloseDone() {
 	})
 }
 
-// PeerConn returns the peer's connection (phone<->agent).
-func (s *Session) PeerConn(role string) *Connection {
+// Close closes Done like CloseDone, but asks the write pump to flush queued
+// frames and send a close frame with code and text first.
+func (c *Connection) Close(code int, text string) {
+	c.closeOnce.Do(func() {
+		c.closeCode, c.closeText = code, text
+		close(c.Done)
+	})
+}
+
+// CloseCode returns the close frame requested by Close. It is only valid once
+// Done is closed, and code is zero if none was requested.
+func (c *Connection) CloseCode() (code int, text string) {
+	return c.closeCode, c.closeText
+}
+
+// PeerConns returns the peer's connections (phone<->agent).
+func (s *Session) PeerConns(role string) []*Connection {
+	if role == "phone" {
+		return s.Conns("agent")
+	}
+	return s.Conns("phone")
+}
+
+// Conns returns the connections registered for a role, ordered by device ID.
+func (s *Session) Conns(role string) []*Connection {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
-	if role == "phone" {
-		return s.AgentConn
+	m := s.roleConns(role)
+	if len(m) == 0 {
+		return nil
+	}
+	conns := make([]*Connection, 0, len(m))
+	for _, c := range m {
+		conns = append(conns, c)
 	}
-	return s.PhoneConn
+	sort.Slice(conns, func(i, j int) bool { return conns[i].DeviceID < conns[j].DeviceID })
+	return conns
 }
 
-// SetConn sets the connection for a role.
-func (s *Session) SetConn(role string, conn *Connection) {
+// DeviceConn returns the connection for a role and device, or nil.
+func (s *Session) DeviceConn(role, deviceID string) *Connection {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.roleConns(role)[deviceID]
+}
+
+// SetConn registers a connection under its role and device and returns the
+// connection it replaced, if any.
+func (s *Session) SetConn(conn *Connection) *Connection {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	if role == "phone" {
-		s.PhoneConn = conn
-	} else {
-		s.AgentConn = conn
+	return s.register(conn)
+}
+
+// register stores conn under its role and device. Callers must hold s.mu.
+func (s *Session) register(conn *Connection) *Connection {
+	m := s.roleConns(conn.Role)
+	if m == nil {
+		m = make(map[string]*Connection)
+		if conn.Role == "phone" {
+			s.Phones = m
+		} else {
+			s.Agents = m
+		}
 	}
+	replaced := m[conn.DeviceID]
+	m[conn.DeviceID] = conn
 	s.LastActive.Store(time.Now())
+	return replaced
 }
 
-// ClearConn clears the connection for a role.
-func (s *Session) ClearConn(role string) {
+// ClearConn removes a connection if it is still the registered one for its
+// role and device. It returns false if the connection was already replaced.
+func (s *Session) ClearConn(conn *Connection) bool {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	if role == "phone" {
-		s.PhoneConn = nil
-	} else {
-		s.AgentConn = nil
+	m := s.roleConns(conn.Role)
+	if m[conn.DeviceID] != conn {
+		return false
 	}
+	delete(m, conn.DeviceID)
+	return true
 }
 
-// IsPaired returns true if both phone and agent are connected.
+// IsPaired returns true if at least one phone and one agent are connected.
 func (s *Session) IsPaired() bool {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
-	return s.PhoneConn != nil && s.AgentConn != nil
-}
-
-// SameRoleConn returns the existing connection of the same role (for replacement).
-func (s *Session) SameRoleConn(role string) *Connection {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
-	if role == "phone" {
-		return s.PhoneConn
-	}
-	return s.AgentConn
+	return len(s.Phones) > 0 && len(s.Agents) > 0
 }
 
 // IsIdle returns true if the session has no connections and has been idle for the given duration.
 func (s *Session) IsIdle(timeout time.Duration) bool {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
-	if s.PhoneConn != nil || s.AgentConn != nil {
+	if len(s.Phones) > 0 || len(s.Agents) > 0 {
 		return false
 	}
 	lastActive, ok := s.LastActive.Load().(time.Time)
@@ -113,3 +185,26 @@ func (s *Session) IsIdle(timeout time.Duration) bool {
 	}
 	return time.Since(lastActive) > timeout
 }
+
+// replayTo returns the replay buffer for frames delivered toward role.
+func (s *Session) replayTo(role string) *replayBuffer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.replay == nil {
+		s.replay = make(map[string]*replayBuffer)
+	}
+	b, ok := s.replay[role]
+	if !ok {
+		b = &replayBuffer{}
+		s.replay[role] = b
+	}
+	return b
+}
+
+// roleConns returns the connection map for a role. Callers must hold s.mu.
+func (s *Session) roleConns(role string) map[string]*Connection {
+	if role == "phone" {
+		return s.Phones
+	}
+	return s.Agents
+}
@@ -14,8 +14,8 @@ func TestNewConnection(t *testing.T) {
 	if conn.Role != "phone" {
 		t.Fatalf("expected role 'phone', got '%s'", conn.Role)
 	}
-	if conn.Send == nil {
-		t.Fatal("Send channel is nil")
+	if conn.Pending() != 0 {
+		t.Fatal("send queue should start empty")
 	}
 	if conn.Done == nil {
 		t.Fatal("Done channel is nil")
@@ -101,20 +101,56 @@ func TestSessionSetAndGetConn(t *testing.T) {
 	session := &Session{Token: "test"}
 	conn := NewConnection(nil, "phone", nil)
 
-	session.SetConn("phone", conn)
-	got := session.PeerConn("agent") // agent's peer is phone
-	if got != conn {
-		t.Fatal("PeerConn(agent) should return the phone connection")
+	session.SetConn(conn)
+	got := session.PeerConns("agent") // agent's peers are phones
+	if len(got) != 1 || got[0] != conn {
+		t.Fatal("PeerConns(agent) should return the phone connection")
 	}
 
-	got = session.SameRoleConn("phone")
-	if got != conn {
-		t.Fatal("SameRoleConn(phone) should return the phone connection")
+	got = session.Conns("phone")
+	if len(got) != 1 || got[0] != conn {
+		t.Fatal("Conns(phone) should return the phone connection")
 	}
 
-	got = session.SameRoleConn("agent")
+	got = session.Conns("agent")
 	if got != nil {
-		t.Fatal("SameRoleConn(agent) should return nil")
+		t.Fatal("Conns(agent) should return nil")
+	}
+}
+
+func TestSessionMultipleDevices(t *testing.T) {
+	session := &Session{Token: "test"}
+	phone := NewConnection(nil, "phone", nil)
+	phone.DeviceID = "phone"
+	tablet := NewConnection(nil, "phone", nil)
+	tablet.DeviceID = "tablet"
+
+	if replaced := session.SetConn(phone); replaced != nil {
+		t.Fatal("first device should not replace anything")
+	}
+	if replaced := session.SetConn(tablet); replaced != nil {
+		t.Fatal("second device should not replace the first")
+	}
+
+	peers := session.PeerConns("agent")
+	if len(peers) != 2 || peers[0] != phone || peers[1] != tablet {
+		t.Fatalf("expected both devices ordered by ID, got %d", len(peers))
+	}
+	if session.DeviceConn("phone", "tablet") != tablet {
+		t.Fatal("DeviceConn(tablet) should return the tablet connection")
+	}
+
+	// Reconnecting the same device replaces only that device
+	phone2 := NewConnection(nil, "phone", nil)
+	phone2.DeviceID = "phone"
+	if replaced := session.SetConn(phone2); replaced != phone {
+		t.Fatal("same device should replace the old connection")
+	}
+	if session.ClearConn(phone) {
+		t.Fatal("ClearConn should ignore a replaced connection")
+	}
+	if len(session.Conns("phone")) != 2 {
+		t.Fatal("replaced connection should not remove the device")
 	}
 }
 
@@ -126,13 +162,13 @@ func TestSessionIsPaired(t *testing.T) {
 	}
 
 	phone := NewConnection(nil, "phone", nil)
-	session.SetConn("phone", phone)
+	session.SetConn(phone)
 	if session.IsPaired() {
 		t.Fatal("should not be paired with only phone")
 	}
 
 	agent := NewConnection(nil, "agent", nil)
-	session.SetConn("agent", agent)
+	session.SetConn(agent)
 	if !session.IsPaired() {
 		t.Fatal("should be paired with both connections")
 	}
@@ -143,14 +179,16 @@ func TestSessionClearConn(t *testing.T) {
 	phone := NewConnection(nil, "phone", nil)
 	agent := NewConnection(nil, "agent", nil)
 
-	session.SetConn("phone", phone)
-	session.SetConn("agent", agent)
+	session.SetConn(phone)
+	session.SetConn(agent)
 
-	session.ClearConn("phone")
-	if session.SameRoleConn("phone") != nil {
-		t.Fatal("phone should be nil after ClearConn")
+	if !session.ClearConn(phone) {
+		t.Fatal("ClearConn should remove the registered phone")
+	}
+	if len(session.Conns("phone")) != 0 {
+		t.Fatal("phone should be gone after ClearConn")
 	}
-	if session.SameRoleConn("agent") != agent {
+	if got := session.Conns("agent"); len(got) != 1 || got[0] != agent {
 		t.Fatal("agent should still be set")
 	}
 }
@@ -177,7 +215,7 @@ func TestSessionIsIdle(t *testing.T) {
 
 	// With a connection, should never be idle
 	conn := NewConnection(nil, "phone", nil)
-	session.SetConn("phone", conn)
+	session.SetConn(conn)
 	session.LastActive.Store(time.Now().Add(-2 * time.Hour))
 	if session.IsIdle(time.Hour) {
 		t.Fatal("session with active connection should not be idle")
@@ -193,14 +231,65 @@ func TestSessionConcurrentAccess(t *testing.T) {
 		go func() {
 			defer wg.Done()
 			conn := NewConnection(nil, "phone", nil)
-			session.SetConn("phone", conn)
+			session.SetConn(conn)
 		}()
 		go func() {
 			defer wg.Done()
-			session.PeerConn("agent")
+			session.PeerConns("agent")
 			session.IsPaired()
-			session.SameRoleConn("phone")
+			session.Conns("phone")
 		}()
 	}
 	wg.Wait()
 }
+
+func TestConnectionSendQueue(t *testing.T) {
+	conn := NewConnection(nil, "phone", nil)
+
+	for i := 0; i < SendQueueSize; i++ {
+		if !conn.Enqueue(Frame{Data: []byte{byte(i)}}) {
+			t.Fatalf("enqueue %d should fit", i)
+		}
+	}
+	if conn.Enqueue(Frame{}) {
+		t.Fatal("enqueue beyond capacity should fail")
+	}
+	if conn.EnqueueWait(Frame{}, 10*time.Millisecond) {
+		t.Fatal("EnqueueWait should time out on a full queue")
+	}
+
+	frame, ok := conn.Next()
+	if !ok || frame.Data[0] != 0 {
+		t.Fatal("Next should return the oldest frame")
+	}
+	if !conn.EnqueueWait(Frame{}, 10*time.Millisecond) {
+		t.Fatal("EnqueueWait should succeed once a slot frees up")
+	}
+
+	conn.CloseDone()
+	if conn.EnqueueWait(Frame{}, 0) {
+		t.Fatal("EnqueueWait should give up on a closed connection")
+	}
+}
+
+func TestControlLanePriority(t *testing.T) {
+	conn := NewConnection(nil, "phone", nil)
+
+	for conn.Enqueue(Frame{Data: []byte("bulk")}) {
+	}
+	if conn.Drops(LaneBulk) != 1 {
+		t.Fatalf("expected 1 bulk drop, got %d", conn.Drops(LaneBulk))
+	}
+
+	// A full bulk lane must not block control frames
+	if !conn.Enqueue(Frame{Data: []byte("control"), Lane: LaneControl}) {
+		t.Fatal("control frame should fit while bulk lane is full")
+	}
+	frame, _ := conn.Next()
+	if string(frame.Data) != "control" {
+		t.Fatalf("control frame should be written first, got %s", frame.Data)
+	}
+	if conn.Drops(LaneControl) != 0 {
+		t.Fatal("no control frames should have been dropped")
+	}
+}
@@ -0,0 +1,172 @@
+package hub
+
+import (
+	"sort"
+	"time"
+
+	"github.com/openclaw/openclaw-relay/internal/protocol"
+)
+
+const (
+	// coalesceWatermark is the peer queue depth at which consecutive
+	// unencrypted chat.stream deltas are merged instead of queued.
+	coalesceWatermark = 16
+	// backpressureTimeout bounds how long an encrypted chat.stream chunk
+	// waits for room in the peer's queue before the sender is told it is full.
+	backpressureTimeout = 10 * time.Second
+)
+
+// deliver queues a forwarded frame on a peer connection. Stream chunks get
+// special treatment when the peer falls behind: unencrypted deltas of the
+// same stream are merged into the frame still waiting at the tail of the
+// queue, and encrypted ones block the sender until there is room, so the
+// agent is slowed down instead of having its stream broken.
+func (h *Hub) deliver(peer, sender *Connection, env *protocol.Envelope, frame Frame) bool {
+	if env.Type != protocol.TypeChatStream {
+		return peer.Enqueue(frame)
+	}
+	if env.Encrypted() {
+		return peer.EnqueueWait(frame, backpressureTimeout)
+	}
+
+	frame.stream = streamKey(sender, env)
+	return peer.EnqueueMerge(frame, coalesceWatermark, func(tail *Frame) bool {
+		if frame.stream == "" || tail.stream != frame.stream {
+			return false
+		}
+		if !mergeDeltas(tail, frame) {
+			return false
+		}
+		tail.OnWritten = bothCallbacks(tail.OnWritten, frame.OnWritten)
+		return true
+	})
+}
+
+// streamKey identifies the stream a chunk belongs to: the sending agent
+// connection plus the optional stream_id. Chunks whose payload does not parse
+// are never merged.
+func streamKey(sender *Connection, env *protocol.Envelope) string {
+	var chunk protocol.ChatStreamPayload
+	if err := env.ParsePayload(&chunk); err != nil {
+		return ""
+	}
+	return sender.DeviceID + "/" + chunk.StreamID
+}
+
+func bothCallbacks(a, b func()) func() {
+	if a == nil {
+		return b
+	}
+	if b == nil {
+		return a
+	}
+	return func() {
+		a()
+		b()
+	}
+}
+
+// openStream is a chat stream an agent connection has started but not yet
+// ended with chat.done or chat.error.
+type openStream struct {
+	id     string
+	seq    int    // last seq seen
+	device string // phone device the stream is addressed to, "" for all
+}
+
+// trackStream follows the chat streams an agent connection has in flight, so
+// a draining relay can wait for them to finish and phones can be told when
+// the agent drops mid-stream. A chunk opens its stream only if the relay
+// accepted it, but chat.done and chat.error end theirs even if they were
+// queued for an offline phone or refused: the agent is done with it either way.
+func (h *Hub) trackStream(sender *Connection, env *protocol.Envelope, accepted bool) {
+	switch env.Type {
+	case protocol.TypeChatStream:
+		if !accepted {
+			return
+		}
+		var chunk protocol.ChatStreamPayload
+		env.ParsePayload(&chunk)
+		if sender.openStream(openStream{id: chunk.StreamID, seq: chunk.Seq, device: env.Device}) {
+			h.streams.Add(1)
+		}
+	case protocol.TypeChatDone:
+		var done protocol.ChatDonePayload
+		env.ParsePayload(&done)
+		if sender.closeStream(done.StreamID) {
+			h.streams.Add(-1)
+		}
+	case protocol.TypeChatError:
+		// Like chat.done, an error without a stream_id ends the unnamed
+		// stream; errors unrelated to a stream leave the others open.
+		var fail protocol.ErrorPayload
+		env.ParsePayload(&fail)
+		if sender.closeStream(fail.StreamID) {
+			h.streams.Add(-1)
+		}
+	}
+}
+
+// interruptStreams tells the phones of every stream a disconnecting agent left
+// open that it will not be finished, with the last seq they should have.
+func (h *Hub) interruptStreams(session *Session, agent *Connection) {
+	streams := agent.closeStreams()
+	h.streams.Add(-int64(len(streams)))
+	for _, st := range streams {
+		payload := protocol.ErrorPayload{
+			Code:     protocol.ErrStreamInterrupted,
+			Message:  "Agent disconnected mid-stream",
+			LastSeq:  st.seq,
+			StreamID: st.id,
+		}
+		phones := session.Conns(protocol.RolePhone)
+		if st.device != "" {
+			phones = nil
+			if phone := session.DeviceConn(protocol.RolePhone, st.device); phone != nil {
+				phones = []*Connection{phone}
+			}
+		}
+		for _, phone := range phones {
+			h.sendErrorPayload(phone, payload, "")
+		}
+	}
+}
+
+// ActiveStreams returns the number of chat streams currently in flight.
+func (h *Hub) ActiveStreams() int64 {
+	return h.streams.Load()
+}
+
+// openStream records a chunk of a stream and reports whether the stream is new.
+func (c *Connection) openStream(st openStream) bool {
+	c.streamMu.Lock()
+	defer c.streamMu.Unlock()
+	if c.streams == nil {
+		c.streams = make(map[string]openStream)
+	}
+	_, open := c.streams[st.id]
+	c.streams[st.id] = st
+	return !open
+}
+
+// closeStream forgets a finished stream and reports whether it was open.
+func (c *Connection) closeStream(id string) bool {
+	c.streamMu.Lock()
+	defer c.streamMu.Unlock()
+	_, open := c.streams[id]
+	delete(c.streams, id)
+	return open
+}
+
+// closeStreams forgets every open stream and returns them, ordered by ID.
+func (c *Connection) closeStreams() []openStream {
+	c.streamMu.Lock()
+	defer c.streamMu.Unlock()
+	streams := make([]openStream, 0, len(c.streams))
+	for _, st := range c.streams {
+		streams = append(streams, st)
+	}
+	c.streams = nil
+	sort.Slice(streams, func(i, j int) bool { return streams[i].id < streams[j].id })
+	return streams
+}
@@ -0,0 +1,107 @@
+package hub
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+
+	"github.com/openclaw/openclaw-relay/internal/protocol"
+	"github.com/openclaw/openclaw-relay/internal/store"
+)
+
+// Takeover policies decide what happens when a connection authenticates for
+// a role and device that already has a connection.
+const (
+	TakeoverReplace   = "replace"    // evict the existing connection (default)
+	TakeoverReject    = "reject"     // refuse the newcomer
+	TakeoverAllowBoth = "allow_both" // keep both, registering the newcomer under a new device ID
+)
+
+// ErrSessionInUse is returned by Authenticate when the token's takeover
+// policy refuses a second connection for the same device.
+var ErrSessionInUse = errors.New("device already connected")
+
+// ValidTakeover reports whether policy is a known takeover policy.
+func ValidTakeover(policy string) bool {
+	switch policy {
+	case TakeoverReplace, TakeoverReject, TakeoverAllowBoth:
+		return true
+	}
+	return false
+}
+
+// SetTakeoverPolicy stores the takeover policy for a token.
+func (h *Hub) SetTakeoverPolicy(token, policy string) error {
+	if !ValidTakeover(policy) {
+		return fmt.Errorf("invalid takeover policy: %s", policy)
+	}
+	policies, ok := h.store.(store.TokenPolicies)
+	if !ok {
+		return errors.New("store does not support token policies")
+	}
+	exists, err := h.store.TokenExists(token)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return ErrInvalidToken
+	}
+	return policies.SetTakeoverPolicy(token, policy)
+}
+
+// TakeoverPolicy returns the takeover policy in effect for a token: its own
+// if one was set, else the hub default.
+func (h *Hub) TakeoverPolicy(token string) string {
+	if policies, ok := h.store.(store.TokenPolicies); ok {
+		policy, err := policies.TakeoverPolicy(token)
+		if err != nil {
+			log.Printf("takeover policy lookup error for %s: %v", token, err)
+		} else if policy != "" {
+			return policy
+		}
+	}
+	if h.config.Takeover != "" {
+		return h.config.Takeover
+	}
+	return TakeoverReplace
+}
+
+// claim registers conn under its role and device according to policy. It
+// returns the connection it replaced, if any, or ErrSessionInUse when the
+// policy refuses the newcomer. With TakeoverAllowBoth a taken device ID gets
+// a "~N" suffix.
+func (s *Session) claim(conn *Connection, policy string) (*Connection, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.roleConns(conn.Role)[conn.DeviceID] != nil {
+		switch policy {
+		case TakeoverReject:
+			return nil, ErrSessionInUse
+		case TakeoverAllowBoth:
+			base := conn.DeviceID
+			for n := 2; s.roleConns(conn.Role)[conn.DeviceID] != nil; n++ {
+				conn.DeviceID = base + "~" + strconv.Itoa(n)
+			}
+		}
+	}
+	return s.register(conn), nil
+}
+
+// evict tells a replaced connection who took over and closes it with
+// CloseReplaced, so the client knows not to reconnect automatically.
+func (h *Hub) evict(old *Connection, auth protocol.AuthPayload) {
+	env, err := protocol.NewEnvelope(protocol.TypeSessionReplaced, protocol.ReplacedPayload{
+		Device:   old.DeviceID,
+		Client:   auth.Client,
+		Platform: auth.Platform,
+	})
+	if err != nil {
+		log.Printf("error creating replaced envelope: %v", err)
+	} else if data, err := env.Marshal(); err != nil {
+		log.Printf("error marshaling replaced envelope: %v", err)
+	} else {
+		old.Enqueue(Frame{Data: data, Lane: LaneControl})
+	}
+	old.Close(protocol.CloseReplaced, "replaced by another connection")
+}
@@ -0,0 +1,267 @@
+package hub
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/openclaw/openclaw-relay/internal/protocol"
+)
+
+const (
+	// DefaultMaxFileSize bounds a single file transfer unless configured.
+	DefaultMaxFileSize int64 = 100 * 1024 * 1024 // 100 MB
+	// maxTransfers bounds the unfinished transfers kept per session; the
+	// least recently active one is forgotten to make room.
+	maxTransfers = 32
+)
+
+// transfer is the relay's record of a file moving between the roles of a
+// session. received counts the bytes forwarded without gaps, acked those the
+// receiver confirmed; a resumed transfer continues from acked.
+type transfer struct {
+	id       string
+	from     string // sending role
+	name     string
+	size     int64
+	sha256   string
+	accepted bool
+	received int64
+	acked    int64
+	updated  time.Time
+}
+
+func (h *Hub) maxFileSize() int64 {
+	if h.config.MaxFileSize > 0 {
+		return h.config.MaxFileSize
+	}
+	return DefaultMaxFileSize
+}
+
+// FileCheck enforces the file transfer rules on unencrypted file.* messages:
+// transfers stay within the size limit and the remaining bandwidth quota,
+// chunks arrive in order and match their hash, and a transfer only completes
+// once every byte was forwarded. Encrypted file payloads are opaque to the
+// relay and pass as ordinary messages.
+func FileCheck(m *Message, next Handler) error {
+	if !strings.HasPrefix(m.Env.Type, "file.") || m.Env.Encrypted() {
+		return next(m)
+	}
+	h, session, role := m.hub, m.Session, m.Sender.Role
+
+	switch m.Env.Type {
+	case protocol.TypeFileOffer:
+		var offer protocol.FileOfferPayload
+		if err := m.Env.ParsePayload(&offer); err != nil || offer.TransferID == "" {
+			return Reject(protocol.ErrInvalidMessage, "Invalid file.offer payload", 0)
+		}
+		if offer.Size <= 0 || offer.Size > h.maxFileSize() {
+			return Reject(protocol.ErrFileTooLarge, fmt.Sprintf("File size must be between 1 and %d bytes", h.maxFileSize()), 0)
+		}
+		t, known := session.transfer(offer.TransferID)
+		if known && (t.from != role || t.size != offer.Size || t.sha256 != offer.SHA256) {
+			return Reject(protocol.ErrInvalidMessage, "Transfer ID belongs to a different file", 0)
+		}
+		remaining, err := h.quotaChecker.Remaining(session.Token)
+		if err != nil {
+			log.Printf("quota check error for %s: %v", session.Token, err)
+		} else if offer.Size-t.acked > remaining {
+			// The quota is not used up yet, QuotaCheck would have said so;
+			// this file alone does not fit
+			return Reject(protocol.ErrFileExceedsQuota, fmt.Sprintf("File exceeds the remaining bandwidth quota of %d bytes", remaining), 0)
+		}
+		if err := next(m); err != nil {
+			return err
+		}
+		if !known {
+			t = transfer{id: offer.TransferID, from: role, name: offer.Name, size: offer.Size, sha256: offer.SHA256}
+		}
+		session.putTransfer(t)
+		return nil
+
+	case protocol.TypeFileAccept:
+		var accept protocol.FileAcceptPayload
+		if err := m.Env.ParsePayload(&accept); err != nil {
+			return Reject(protocol.ErrInvalidMessage, "Invalid file.accept payload", 0)
+		}
+		t, err := session.receiving(accept.TransferID, role)
+		if err != nil {
+			return err
+		}
+		if accept.Offset < 0 || accept.Offset > t.size {
+			return Reject(protocol.ErrInvalidMessage, "Offset outside the file", 0)
+		}
+		if err := next(m); err != nil {
+			return err
+		}
+		// The sender resumes wherever the receiver asks, even before
+		// data the relay already forwarded
+		t.accepted, t.received, t.acked = true, accept.Offset, accept.Offset
+		session.putTransfer(t)
+		return nil
+
+	case protocol.TypeFileChunk:
+		var chunk protocol.FileChunkPayload
+		if err := m.Env.ParsePayload(&chunk); err != nil {
+			return Reject(protocol.ErrInvalidMessage, "Invalid file.chunk payload", 0)
+		}
+		t, err := session.sending(chunk.TransferID, role)
+		if err != nil {
+			return err
+		}
+		if !t.accepted {
+			return Reject(protocol.ErrInvalidMessage, "Transfer has not been accepted", 0)
+		}
+		data, err := base64.StdEncoding.DecodeString(chunk.DataB64)
+		if err != nil || len(data) == 0 {
+			return Reject(protocol.ErrInvalidMessage, "Invalid chunk data", 0)
+		}
+		if chunk.SHA256 != "" {
+			sum := sha256.Sum256(data)
+			if !strings.EqualFold(chunk.SHA256, hex.EncodeToString(sum[:])) {
+				return Reject(protocol.ErrInvalidMessage, "Chunk hash mismatch", 0)
+			}
+		}
+		end := chunk.Offset + int64(len(data))
+		if chunk.Offset < 0 || chunk.Offset > t.received {
+			return Reject(protocol.ErrInvalidMessage, fmt.Sprintf("Chunk out of order, expected offset %d", t.received), 0)
+		}
+		if end > t.size {
+			return Reject(protocol.ErrFileTooLarge, "Chunk extends past the offered size", 0)
+		}
+		if err := next(m); err != nil {
+			return err
+		}
+		session.updateTransfer(t.id, func(t *transfer) { t.received = max(t.received, end) })
+		return nil
+
+	case protocol.TypeFileAck:
+		var ack protocol.FileAckPayload
+		if err := m.Env.ParsePayload(&ack); err != nil {
+			return Reject(protocol.ErrInvalidMessage, "Invalid file.ack payload", 0)
+		}
+		if _, err := session.receiving(ack.TransferID, role); err != nil {
+			return err
+		}
+		if err := next(m); err != nil {
+			return err
+		}
+		session.updateTransfer(ack.TransferID, func(t *transfer) {
+			t.acked = max(t.acked, min(ack.Offset, t.received))
+		})
+		return nil
+
+	case protocol.TypeFileComplete:
+		var done protocol.FileCompletePayload
+		if err := m.Env.ParsePayload(&done); err != nil {
+			return Reject(protocol.ErrInvalidMessage, "Invalid file.complete payload", 0)
+		}
+		t, err := session.sending(done.TransferID, role)
+		if err != nil {
+			return err
+		}
+		if t.received != t.size {
+			return Reject(protocol.ErrInvalidMessage, fmt.Sprintf("Transfer incomplete, %d of %d bytes sent", t.received, t.size), 0)
+		}
+		if err := next(m); err != nil {
+			return err
+		}
+		session.removeTransfer(t.id)
+		return nil
+	}
+	return next(m)
+}
+
+// transfer returns a copy of the transfer with id.
+func (s *Session) transfer(id string) (transfer, bool) {
+	s.xferMu.Lock()
+	defer s.xferMu.Unlock()
+	t, ok := s.transfers[id]
+	if !ok {
+		return transfer{}, false
+	}
+	return *t, true
+}
+
+// sending returns the transfer with id if role is its sender.
+func (s *Session) sending(id, role string) (transfer, error) {
+	t, ok := s.transfer(id)
+	if !ok || t.from != role {
+		return t, Reject(protocol.ErrInvalidMessage, "Unknown transfer", 0)
+	}
+	return t, nil
+}
+
+// receiving returns the transfer with id if role is its receiver.
+func (s *Session) receiving(id, role string) (transfer, error) {
+	t, ok := s.transfer(id)
+	if !ok || t.from == role {
+		return t, Reject(protocol.ErrInvalidMessage, "Unknown transfer", 0)
+	}
+	return t, nil
+}
+
+// putTransfer stores t, forgetting the least recently active transfer if
+// the session already has too many.
+func (s *Session) putTransfer(t transfer) {
+	s.xferMu.Lock()
+	defer s.xferMu.Unlock()
+	if s.transfers == nil {
+		s.transfers = make(map[string]*transfer)
+	}
+	if _, ok := s.transfers[t.id]; !ok && len(s.transfers) >= maxTransfers {
+		var oldest *transfer
+		for _, other := range s.transfers {
+			if oldest == nil || other.updated.Before(oldest.updated) {
+				oldest = other
+			}
+		}
+		delete(s.transfers, oldest.id)
+	}
+	t.updated = time.Now()
+	s.transfers[t.id] = &t
+}
+
+// updateTransfer applies change to the transfer with id, if it still exists.
+func (s *Session) updateTransfer(id string, change func(*transfer)) {
+	s.xferMu.Lock()
+	defer s.xferMu.Unlock()
+	if t, ok := s.transfers[id]; ok {
+		change(t)
+		t.updated = time.Now()
+	}
+}
+
+func (s *Session) removeTransfer(id string) {
+	s.xferMu.Lock()
+	defer s.xferMu.Unlock()
+	delete(s.transfers, id)
+}
+
+// Transfers returns the unfinished transfers a connection of role takes part
+// in, so it can resume them, ordered by transfer ID.
+func (s *Session) Transfers(role string) []protocol.FileProgress {
+	s.xferMu.Lock()
+	defer s.xferMu.Unlock()
+	var progress []protocol.FileProgress
+	for _, t := range s.transfers {
+		direction := "receive"
+		if t.from == role {
+			direction = "send"
+		}
+		progress = append(progress, protocol.FileProgress{
+			TransferID: t.id,
+			Direction:  direction,
+			Name:       t.name,
+			Size:       t.size,
+			Offset:     t.acked,
+		})
+	}
+	sort.Slice(progress, func(i, j int) bool { return progress[i].TransferID < progress[j].TransferID })
+	return progress
+}
@@ -0,0 +1,89 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// Frame encodings a connection can choose in auth.
+const (
+	EncodingJSON = "json" // text frames (default)
+	EncodingCBOR = "cbor" // binary frames carrying the envelope as CBOR
+)
+
+// ValidEncoding reports whether enc names a supported encoding; "" means JSON.
+func ValidEncoding(enc string) bool {
+	return enc == "" || enc == EncodingJSON || enc == EncodingCBOR
+}
+
+var (
+	cborDec, _ = cbor.DecOptions{
+		DefaultMapType: reflect.TypeOf(map[string]interface{}{}),
+	}.DecMode()
+	cborEnc, _ = cbor.CoreDetEncOptions().EncMode()
+)
+
+// BinaryField reports whether values of a key carry raw bytes: base64 strings
+// in JSON, byte strings in CBOR.
+func BinaryField(key string) bool {
+	return strings.HasSuffix(key, "_b64") || key == "ciphertext" || key == "nonce"
+}
+
+// DecodeBinary converts a CBOR-encoded envelope to its JSON form. Byte
+// strings become base64 strings.
+func DecodeBinary(data []byte) ([]byte, error) {
+	var v interface{}
+	if err := cborDec.Unmarshal(data, &v); err != nil {
+		return nil, err
+	}
+	if _, ok := v.(map[string]interface{}); !ok {
+		return nil, fmt.Errorf("envelope is not a map")
+	}
+	return json.Marshal(v)
+}
+
+// EncodeBinary converts a JSON envelope to CBOR. Base64 strings under
+// binary fields are sent as byte strings.
+func EncodeBinary(raw []byte) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	return cborEnc.Marshal(toCBOR("", v))
+}
+
+// toCBOR prepares a decoded JSON value for CBOR: numbers keep their integer
+// type and binary fields are decoded from base64.
+func toCBOR(key string, v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, item := range v {
+			v[k] = toCBOR(k, item)
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = toCBOR(key, item)
+		}
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return n
+		}
+		f, _ := v.Float64()
+		return f
+	case string:
+		if BinaryField(key) {
+			if b, err := base64.StdEncoding.DecodeString(v); err == nil {
+				return b
+			}
+		}
+	}
+	return v
+}
@@ -13,6 +13,10 @@ type Envelope struct {
 	Type    string          `json:"type"`
 	ID      string          `json:"id"`
 	TS      int64           `json:"ts"`
+	Device  string          `json:"device,omitempty"`
+	RSeq    uint64          `json:"rseq,omitempty"`
+	ReplyTo string          `json:"reply_to,omitempty"` // ID of the request this answers
+	TTLMs   int64           `json:"ttl_ms,omitempty"`   // drop if not delivered within this long
 	Payload json.RawMessage `json:"payload"`
 }
 
@@ -31,16 +35,64 @@ func NewEnvelope(msgType string, payload interface{}) (*Envelope, error) {
 	}, nil
 }
 
+// Deadline returns when a message the relay received at received expires,
+// or the zero time if it sets no ttl_ms.
+func (e *Envelope) Deadline(received time.Time) time.Time {
+	if e.TTLMs <= 0 {
+		return time.Time{}
+	}
+	return received.Add(time.Duration(e.TTLMs) * time.Millisecond)
+}
+
 // ParsePayload unmarshals the payload into the given target.
 func (e *Envelope) ParsePayload(target interface{}) error {
 	return json.Unmarshal(e.Payload, target)
 }
 
+// AgentID returns the agent_id named in the payload, if any. Encrypted
+// payloads never expose one.
+func (e *Envelope) AgentID() string {
+	var target struct {
+		AgentID string `json:"agent_id"`
+	}
+	if err := json.Unmarshal(e.Payload, &target); err != nil {
+		return ""
+	}
+	return target.AgentID
+}
+
+// Encrypted reports whether the payload is end-to-end encrypted and therefore
+// opaque to the relay.
+func (e *Envelope) Encrypted() bool {
+	var target struct {
+		Enc bool `json:"enc"`
+	}
+	if err := json.Unmarshal(e.Payload, &target); err != nil {
+		return false
+	}
+	return target.Enc
+}
+
 // Marshal serializes the envelope to JSON bytes.
 func (e *Envelope) Marshal() ([]byte, error) {
 	return json.Marshal(e)
 }
 
+// SetField returns a copy of a raw JSON envelope with one top-level field
+// replaced. Fields the relay does not know about are preserved.
+func SetField(raw []byte, key string, value interface{}) ([]byte, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	fields[key] = data
+	return json.Marshal(fields)
+}
+
 func generateID() string {
 	b := make([]byte, 16)
 	if _, err := rand.Read(b); err != nil {
@@ -0,0 +1,169 @@
+package protocol
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Route targets
+const (
+	TargetPeer  = "peer"  // forwarded to the other role
+	TargetRelay = "relay" // handled by the relay itself
+)
+
+// Policies for message types without a route
+const (
+	UnknownReject = "reject" // answer with INVALID_MESSAGE
+	UnknownPass   = "pass"   // forward to the peer like any metered message
+)
+
+// Route describes how the relay treats one message type. Type is either an
+// exact message type or a namespace wildcard such as "group.*".
+type Route struct {
+	Type    string   `json:"type"`
+	From    []string `json:"from"`    // roles allowed to send it
+	Target  string   `json:"target"`  // TargetPeer or TargetRelay
+	Metered bool     `json:"metered"` // counts against rate limit and bandwidth quota
+	// Result is the message type that answers this request. The relay
+	// tracks requests with a result and fails them if the peer does not
+	// answer within TimeoutMs (0 = the relay default) or disconnects.
+	Result    string `json:"result,omitempty"`
+	TimeoutMs int64  `json:"timeout_ms,omitempty"`
+	// Ephemeral messages are forwarded best effort: never queued, replayed
+	// or persisted, exempt from rate limits and bandwidth accounting, and
+	// silently dropped if the peer is offline or backlogged.
+	Ephemeral bool `json:"ephemeral,omitempty"`
+}
+
+// Allows reports whether role may send messages on this route.
+func (r Route) Allows(role string) bool {
+	for _, from := range r.From {
+		if from == role {
+			return true
+		}
+	}
+	return false
+}
+
+// RoutingTable is the relay's message routing policy.
+type RoutingTable struct {
+	Routes  []Route `json:"routes"`
+	Unknown string  `json:"unknown"`
+}
+
+var (
+	fromPhone = []string{RolePhone}
+	fromAgent = []string{RoleAgent}
+	fromBoth  = []string{RolePhone, RoleAgent}
+)
+
+// DefaultRoutingTable returns the built-in routing policy covering every
+// message type defined in this package.
+func DefaultRoutingTable() *RoutingTable {
+	return &RoutingTable{
+		Unknown: UnknownReject,
+		Routes: []Route{
+			{Type: TypePing, From: fromBoth, Target: TargetRelay},
+			{Type: TypePong, From: fromBoth, Target: TargetRelay},
+			{Type: TypeAck, From: fromBoth, Target: TargetRelay},
+			{Type: TypePresenceSet, From: fromBoth, Target: TargetRelay},
+
+			{Type: TypeChatSend, From: fromPhone, Target: TargetPeer, Metered: true},
+			{Type: TypeChatStream, From: fromAgent, Target: TargetPeer, Metered: true},
+			{Type: TypeChatDone, From: fromAgent, Target: TargetPeer, Metered: true},
+			{Type: TypeChatError, From: fromBoth, Target: TargetPeer, Metered: true},
+			{Type: TypeChatToolStatus, From: fromAgent, Target: TargetPeer, Metered: true},
+			{Type: TypeChatHistory, From: fromPhone, Target: TargetPeer, Metered: true, Result: TypeChatHistoryResult},
+			{Type: TypeChatHistoryResult, From: fromAgent, Target: TargetPeer, Metered: true},
+			{Type: TypeKeyExchange, From: fromBoth, Target: TargetPeer, Metered: true},
+
+			{Type: TypeAgentList, From: fromPhone, Target: TargetPeer, Metered: true, Result: TypeAgentListResult},
+			{Type: TypeAgentCreate, From: fromPhone, Target: TargetPeer, Metered: true, Result: TypeAgentResult},
+			{Type: TypeAgentUpdate, From: fromPhone, Target: TargetPeer, Metered: true, Result: TypeAgentResult},
+			{Type: TypeAgentDelete, From: fromPhone, Target: TargetPeer, Metered: true, Result: TypeAgentResult},
+			{Type: TypeAgentListResult, From: fromAgent, Target: TargetPeer, Metered: true},
+			{Type: TypeAgentResult, From: fromAgent, Target: TargetPeer, Metered: true},
+
+			{Type: TypeMemorySearch, From: fromPhone, Target: TargetPeer, Metered: true, Result: TypeMemorySearchResult},
+			{Type: TypeMemorySearchResult, From: fromAgent, Target: TargetPeer, Metered: true},
+
+			{Type: TypeGroupList, From: fromPhone, Target: TargetPeer, Metered: true, Result: TypeGroupListResult},
+			{Type: TypeGroupMessages, From: fromPhone, Target: TargetPeer, Metered: true, Result: TypeGroupMessagesResult},
+			{Type: TypeGroupSend, From: fromPhone, Target: TargetPeer, Metered: true},
+			{Type: TypeGroupListResult, From: fromAgent, Target: TargetPeer, Metered: true},
+			{Type: TypeGroupMessagesResult, From: fromAgent, Target: TargetPeer, Metered: true},
+			{Type: TypeGroupMessage, From: fromAgent, Target: TargetPeer, Metered: true},
+
+			{Type: NamespaceEphemeral + "*", From: fromBoth, Target: TargetPeer, Ephemeral: true},
+
+			{Type: TypeFileOffer, From: fromBoth, Target: TargetPeer, Metered: true},
+			{Type: TypeFileAccept, From: fromBoth, Target: TargetPeer, Metered: true},
+			{Type: TypeFileChunk, From: fromBoth, Target: TargetPeer, Metered: true},
+			{Type: TypeFileAck, From: fromBoth, Target: TargetPeer, Metered: true},
+			{Type: TypeFileComplete, From: fromBoth, Target: TargetPeer, Metered: true},
+
+			{Type: TypeSystemStatus, From: fromPhone, Target: TargetPeer, Metered: true, Result: TypeSystemStatusResult},
+			{Type: TypeSystemStatusResult, From: fromAgent, Target: TargetPeer, Metered: true},
+		},
+	}
+}
+
+// LoadRoutingTable reads a routing table from a JSON file.
+func LoadRoutingTable(path string) (*RoutingTable, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var t RoutingTable
+	if err := json.Unmarshal(data, &t); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	if err := t.Validate(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &t, nil
+}
+
+// Validate checks that every route has a known target and roles.
+func (t *RoutingTable) Validate() error {
+	switch t.Unknown {
+	case "":
+		t.Unknown = UnknownReject
+	case UnknownReject, UnknownPass:
+	default:
+		return fmt.Errorf("unknown policy %q", t.Unknown)
+	}
+	for _, r := range t.Routes {
+		if r.Type == "" {
+			return fmt.Errorf("route without type")
+		}
+		if r.Target != TargetPeer && r.Target != TargetRelay {
+			return fmt.Errorf("route %s: invalid target %q", r.Type, r.Target)
+		}
+		for _, role := range r.From {
+			if role != RolePhone && role != RoleAgent {
+				return fmt.Errorf("route %s: invalid role %q", r.Type, role)
+			}
+		}
+	}
+	return nil
+}
+
+// Lookup returns the route for a message type. Exact routes win over
+// namespace wildcards, and longer wildcards over shorter ones.
+func (t *RoutingTable) Lookup(msgType string) (Route, bool) {
+	var best Route
+	found := false
+	for _, r := range t.Routes {
+		if r.Type == msgType {
+			return r, true
+		}
+		ns, ok := strings.CutSuffix(r.Type, "*")
+		if ok && strings.HasPrefix(msgType, ns) && (!found || len(r.Type) > len(best.Type)) {
+			best, found = r, true
+		}
+	}
+	return best, found
+}
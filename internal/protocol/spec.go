@@ -0,0 +1,278 @@
+package protocol
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// AsyncAPIVersion is the AsyncAPI specification version Spec emits.
+const AsyncAPIVersion = "2.6.0"
+
+// senderRelay stands for the relay in a message's x-from.
+const senderRelay = "relay"
+
+// relayPayloads maps the types the relay itself sends to their payloads.
+// A nil payload is sent as null.
+var relayPayloads = map[string]reflect.Type{
+	TypeAuthOk:          reflect.TypeOf(AuthOkPayload{}),
+	TypeAuthFail:        reflect.TypeOf(ErrorPayload{}),
+	TypeChatError:       reflect.TypeOf(ErrorPayload{}),
+	TypeStatus:          reflect.TypeOf(StatusPayload{}),
+	TypeDelivered:       reflect.TypeOf(DeliveredPayload{}),
+	TypeSessionReplaced: reflect.TypeOf(ReplacedPayload{}),
+	TypeSystemReconnect: reflect.TypeOf(ReconnectPayload{}),
+	TypeSystemNotice:    reflect.TypeOf(NoticePayload{}),
+	TypePong:            nil,
+}
+
+var rawMessageType = reflect.TypeOf(json.RawMessage{})
+
+// Spec describes the protocol spoken at the given envelope version as an
+// AsyncAPI document, payloads as JSON Schema derived from the Go types. Which
+// messages exist, who may send them and how the relay treats them comes from
+// table, so the document matches a relay running with it.
+func Spec(table *RoutingTable, version int, relayVersion string) (map[string]interface{}, error) {
+	if _, ok := NegotiateVersion([]int{version}, version); !ok {
+		return nil, fmt.Errorf("unsupported protocol version %d", version)
+	}
+	b := &schemaBuilder{defs: make(map[string]interface{})}
+	envelope := b.envelope(version)
+
+	types := map[string]bool{TypeAuth: true}
+	for _, r := range table.Routes {
+		types[r.Type] = true
+	}
+	for t := range payloadTypes {
+		types[t] = true
+	}
+	for t := range relayPayloads {
+		types[t] = true
+	}
+
+	messages := make(map[string]interface{})
+	var publish, subscribe []interface{}
+	for _, t := range sortedKeys(types) {
+		route, routed := table.Lookup(t)
+		if t == TypeAuth {
+			route, routed = Route{Type: t, From: []string{RolePhone, RoleAgent}, Target: TargetRelay}, true
+		}
+		relayPayload, fromRelay := relayPayloads[t]
+		if !routed && !fromRelay {
+			// The relay rejects it, e.g. a type a custom table omits
+			continue
+		}
+
+		// Types without a payload struct are defined by the clients
+		payload := map[string]interface{}{}
+		switch p, ok := payloadTypes[t]; {
+		case ok:
+			payload = b.schema(p)
+		case t == TypeAuth:
+			payload = b.schema(reflect.TypeOf(AuthPayload{}))
+		case fromRelay && relayPayload != nil:
+			payload = b.schema(relayPayload)
+		case fromRelay:
+			payload = map[string]interface{}{"type": "null"}
+		}
+		if routed && route.Target == TargetPeer && len(payload) > 0 {
+			// Peers may encrypt anything they send each other. anyOf, as a
+			// lenient struct may match an encrypted payload too.
+			payload = map[string]interface{}{"anyOf": []interface{}{payload, ref("EncryptedPayload")}}
+		}
+
+		typeSchema := map[string]interface{}{"type": "string", "const": t}
+		summary := ""
+		if ns, wildcard := strings.CutSuffix(t, "*"); wildcard {
+			// A namespace admits types this package does not define. The
+			// ones it defines have their own message and are excluded here.
+			typeSchema = map[string]interface{}{"type": "string", "pattern": "^" + strings.ReplaceAll(ns, ".", `\.`)}
+			var defined []string
+			for _, other := range sortedKeys(types) {
+				if other != t && strings.HasPrefix(other, ns) {
+					if r, _ := table.Lookup(other); r.Type == t {
+						defined = append(defined, other)
+					}
+				}
+			}
+			if len(defined) > 0 {
+				typeSchema["not"] = map[string]interface{}{"enum": defined}
+			}
+			summary = "Any other type in the " + strings.TrimSuffix(ns, ".") + " namespace"
+		}
+		msg := map[string]interface{}{
+			"name": t,
+			"payload": map[string]interface{}{
+				"allOf": []interface{}{envelope, map[string]interface{}{
+					"properties": map[string]interface{}{"type": typeSchema, "payload": payload},
+				}},
+			},
+		}
+		if summary != "" {
+			msg["summary"] = summary
+		}
+		var from []string
+		if routed {
+			from = append(from, route.From...)
+			msg["x-target"] = route.Target
+			if route.Metered {
+				msg["x-metered"] = true
+			}
+			if route.Ephemeral {
+				msg["x-ephemeral"] = true
+			}
+			if route.Result != "" {
+				msg["x-result"] = route.Result
+			}
+			if route.TimeoutMs > 0 {
+				msg["x-timeout-ms"] = route.TimeoutMs
+			}
+			publish = append(publish, messageRef(t))
+		}
+		if fromRelay {
+			from = append(from, senderRelay)
+		}
+		msg["x-from"] = from
+		if fromRelay || route.Target == TargetPeer {
+			subscribe = append(subscribe, messageRef(t))
+		}
+		messages[t] = msg
+	}
+
+	b.defs["EncryptedPayload"] = map[string]interface{}{
+		"type":     "object",
+		"required": []string{"enc", "ciphertext", "nonce"},
+		"properties": map[string]interface{}{
+			"enc":        map[string]interface{}{"type": "boolean", "const": true},
+			"ciphertext": map[string]interface{}{"type": "string", "contentEncoding": "base64"},
+			"nonce":      map[string]interface{}{"type": "string", "contentEncoding": "base64"},
+		},
+	}
+
+	return map[string]interface{}{
+		"asyncapi": AsyncAPIVersion,
+		"info": map[string]interface{}{
+			"title":               "CoralMux Relay",
+			"version":             relayVersion,
+			"x-protocol-version":  version,
+			"x-protocol-versions": SupportedVersions,
+		},
+		"defaultContentType": "application/json",
+		"channels": map[string]interface{}{
+			"/ws": map[string]interface{}{
+				"description": "Messages clients send (publish) and receive (subscribe).",
+				"publish":     map[string]interface{}{"message": map[string]interface{}{"oneOf": publish}},
+				"subscribe":   map[string]interface{}{"message": map[string]interface{}{"oneOf": subscribe}},
+			},
+		},
+		"components": map[string]interface{}{
+			"messages": messages,
+			"schemas":  b.defs,
+		},
+		"x-unknown-types": table.Unknown,
+	}, nil
+}
+
+func ref(name string) map[string]interface{} {
+	return map[string]interface{}{"$ref": "#/components/schemas/" + name}
+}
+
+func messageRef(msgType string) map[string]interface{} {
+	return map[string]interface{}{"$ref": "#/components/messages/" + msgType}
+}
+
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for k := range set {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// schemaBuilder derives JSON Schemas from Go types the way encoding/json
+// maps them. Named structs are collected in defs and referenced.
+type schemaBuilder struct {
+	defs map[string]interface{}
+}
+
+// envelope returns a reference to the envelope schema of version, in which
+// version 2 moves the metadata fields under "meta".
+func (b *schemaBuilder) envelope(version int) map[string]interface{} {
+	r := b.schema(reflect.TypeOf(Envelope{}))
+	def := b.defs["Envelope"].(map[string]interface{})
+	props := def["properties"].(map[string]interface{})
+	props["v"] = map[string]interface{}{"type": "integer", "const": version}
+	if version != ProtocolVersion {
+		meta := make(map[string]interface{})
+		for _, key := range metaFields {
+			meta[key] = props[key]
+			delete(props, key)
+		}
+		props["meta"] = map[string]interface{}{"type": "object", "properties": meta}
+	}
+	return r
+}
+
+func (b *schemaBuilder) schema(t reflect.Type) map[string]interface{} {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == rawMessageType {
+		return map[string]interface{}{}
+	}
+	switch t.Kind() {
+	case reflect.Struct:
+		if t.Name() == "" {
+			return b.object(t)
+		}
+		if _, ok := b.defs[t.Name()]; !ok {
+			b.defs[t.Name()] = nil // guards against recursion
+			b.defs[t.Name()] = b.object(t)
+		}
+		return ref(t.Name())
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": "string", "contentEncoding": "base64"}
+		}
+		return map[string]interface{}{"type": "array", "items": b.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": b.schema(t.Elem())}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer", "minimum": 0}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	}
+	return map[string]interface{}{}
+}
+
+// object builds the schema of a struct. Like ValidatePayload, it requires
+// fields without omitempty and allows unknown ones.
+func (b *schemaBuilder) object(t reflect.Type) map[string]interface{} {
+	props := make(map[string]interface{})
+	required := []string{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, omitempty := jsonName(f)
+		if name == "" {
+			continue
+		}
+		prop := b.schema(f.Type)
+		if BinaryField(name) && prop["type"] == "string" {
+			prop["contentEncoding"] = "base64"
+		}
+		props[name] = prop
+		if !omitempty {
+			required = append(required, name)
+		}
+	}
+	return map[string]interface{}{"type": "object", "properties": props, "required": required}
+}
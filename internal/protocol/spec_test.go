@@ -0,0 +1,146 @@
+package protocol
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+// specJSON generates the spec and decodes it back, as a client would read it.
+func specJSON(t *testing.T, table *RoutingTable, version int) map[string]interface{} {
+	t.Helper()
+	spec, err := Spec(table, version, "test")
+	if err != nil {
+		t.Fatalf("Spec: %v", err)
+	}
+	data, err := json.Marshal(spec)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	var doc map[string]interface{}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	return doc
+}
+
+// messageSchemas returns the type and payload schemas of a message.
+func messageSchemas(t *testing.T, doc map[string]interface{}, msgType string) (msg, typ, payload map[string]interface{}) {
+	t.Helper()
+	msg, ok := doc["components"].(map[string]interface{})["messages"].(map[string]interface{})[msgType].(map[string]interface{})
+	if !ok {
+		t.Fatalf("no message %s", msgType)
+	}
+	props := msg["payload"].(map[string]interface{})["allOf"].([]interface{})[1].(map[string]interface{})["properties"].(map[string]interface{})
+	return msg, props["type"].(map[string]interface{}), props["payload"].(map[string]interface{})
+}
+
+func schemaDef(doc map[string]interface{}, name string) map[string]interface{} {
+	return doc["components"].(map[string]interface{})["schemas"].(map[string]interface{})[name].(map[string]interface{})
+}
+
+func TestSpecKnownTypes(t *testing.T) {
+	doc := specJSON(t, DefaultRoutingTable(), ProtocolVersion)
+	if doc["asyncapi"] != AsyncAPIVersion {
+		t.Fatalf("asyncapi = %v", doc["asyncapi"])
+	}
+
+	msg, typ, payload := messageSchemas(t, doc, TypeChatSend)
+	if typ["const"] != TypeChatSend {
+		t.Fatalf("chat.send type schema = %v", typ)
+	}
+	if !reflect.DeepEqual(msg["x-from"], []interface{}{RolePhone}) || msg["x-target"] != TargetPeer || msg["x-metered"] != true {
+		t.Fatalf("chat.send routing = %v %v %v", msg["x-from"], msg["x-target"], msg["x-metered"])
+	}
+	want := []interface{}{
+		map[string]interface{}{"$ref": "#/components/schemas/ChatSendPayload"},
+		map[string]interface{}{"$ref": "#/components/schemas/EncryptedPayload"},
+	}
+	if !reflect.DeepEqual(payload["anyOf"], want) {
+		t.Fatalf("chat.send payload = %v", payload)
+	}
+	send := schemaDef(doc, "ChatSendPayload")
+	if !reflect.DeepEqual(send["required"], []interface{}{"text"}) {
+		t.Fatalf("ChatSendPayload required = %v", send["required"])
+	}
+	items := send["properties"].(map[string]interface{})["attachments"].(map[string]interface{})["items"]
+	if !reflect.DeepEqual(items, map[string]interface{}{"$ref": "#/components/schemas/Attachment"}) {
+		t.Fatalf("attachments items = %v", items)
+	}
+
+	// Sent only by the relay: subscribe, not publish
+	msg, _, payload = messageSchemas(t, doc, TypeAuthOk)
+	if !reflect.DeepEqual(msg["x-from"], []interface{}{senderRelay}) || msg["x-target"] != nil {
+		t.Fatalf("auth.ok routing = %v %v", msg["x-from"], msg["x-target"])
+	}
+	if payload["$ref"] != "#/components/schemas/AuthOkPayload" {
+		t.Fatalf("auth.ok payload = %v", payload)
+	}
+}
+
+func TestSpecEncryptedPayloads(t *testing.T) {
+	doc := specJSON(t, DefaultRoutingTable(), ProtocolVersion)
+
+	// A client-defined payload is already open to any value, encrypted or not.
+	// Wrapping it would make an encrypted payload match both branches.
+	for _, msgType := range []string{TypeAgentList, "ephemeral.*"} {
+		_, _, payload := messageSchemas(t, doc, msgType)
+		if len(payload) != 0 {
+			t.Fatalf("%s payload = %v, want {}", msgType, payload)
+		}
+	}
+
+	enc := schemaDef(doc, "EncryptedPayload")
+	if !reflect.DeepEqual(enc["required"], []interface{}{"enc", "ciphertext", "nonce"}) {
+		t.Fatalf("EncryptedPayload required = %v", enc["required"])
+	}
+}
+
+func TestSpecWildcardExcludesDefinedTypes(t *testing.T) {
+	doc := specJSON(t, DefaultRoutingTable(), ProtocolVersion)
+
+	msg, typ, _ := messageSchemas(t, doc, "ephemeral.*")
+	if typ["pattern"] != `^ephemeral\.` || msg["summary"] == nil {
+		t.Fatalf("ephemeral.* type schema = %v", typ)
+	}
+	if !reflect.DeepEqual(typ["not"], map[string]interface{}{"enum": []interface{}{TypeEphemeralTyping}}) {
+		t.Fatalf("ephemeral.* does not exclude %s: %v", TypeEphemeralTyping, typ["not"])
+	}
+	if _, typ, _ = messageSchemas(t, doc, TypeEphemeralTyping); typ["const"] != TypeEphemeralTyping {
+		t.Fatalf("ephemeral.typing type schema = %v", typ)
+	}
+}
+
+func TestSpecVersions(t *testing.T) {
+	for _, v := range SupportedVersions {
+		doc := specJSON(t, DefaultRoutingTable(), v)
+		props := schemaDef(doc, "Envelope")["properties"].(map[string]interface{})
+		if props["v"].(map[string]interface{})["const"] != float64(v) {
+			t.Fatalf("v%d: envelope v = %v", v, props["v"])
+		}
+		_, nested := props["meta"]
+		if nested != (v != ProtocolVersion) {
+			t.Fatalf("v%d: envelope meta present = %v", v, nested)
+		}
+	}
+	if _, err := Spec(DefaultRoutingTable(), 99, "test"); err == nil {
+		t.Fatal("expected an error for an unsupported version")
+	}
+}
+
+func TestSpecFollowsTable(t *testing.T) {
+	table := &RoutingTable{Unknown: UnknownReject, Routes: []Route{
+		{Type: TypeChatSend, From: []string{RoleAgent}, Target: TargetPeer},
+	}}
+	doc := specJSON(t, table, ProtocolVersion)
+	messages := doc["components"].(map[string]interface{})["messages"].(map[string]interface{})
+	if _, ok := messages[TypeChatStream]; ok {
+		t.Fatal("chat.stream is described but not routed")
+	}
+	if msg, _, _ := messageSchemas(t, doc, TypeChatSend); !reflect.DeepEqual(msg["x-from"], []interface{}{RoleAgent}) {
+		t.Fatalf("chat.send x-from = %v", msg["x-from"])
+	}
+	if _, ok := messages[TypeAuthOk]; !ok {
+		t.Fatal("relay messages missing")
+	}
+}
@@ -0,0 +1,47 @@
+package protocol
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// MergeStreamDeltas folds two consecutive chat.stream envelopes into one. The
+// result keeps the later envelope's fields and seq, concatenates the deltas,
+// and records the first merged seq in seq_start so clients can tell the
+// chunks in between were coalesced rather than lost.
+func MergeStreamDeltas(prev, next []byte) ([]byte, error) {
+	var prevEnv, nextEnv map[string]json.RawMessage
+	if err := json.Unmarshal(prev, &prevEnv); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(next, &nextEnv); err != nil {
+		return nil, err
+	}
+
+	var prevPayload ChatStreamPayload
+	if err := json.Unmarshal(prevEnv["payload"], &prevPayload); err != nil {
+		return nil, err
+	}
+	var nextPayload map[string]json.RawMessage
+	if err := json.Unmarshal(nextEnv["payload"], &nextPayload); err != nil {
+		return nil, err
+	}
+	var delta string
+	if err := json.Unmarshal(nextPayload["delta"], &delta); err != nil {
+		return nil, fmt.Errorf("delta: %w", err)
+	}
+
+	seqStart := prevPayload.SeqStart
+	if seqStart == 0 {
+		seqStart = prevPayload.Seq
+	}
+	nextPayload["delta"], _ = json.Marshal(prevPayload.Delta + delta)
+	nextPayload["seq_start"], _ = json.Marshal(seqStart)
+
+	payload, err := json.Marshal(nextPayload)
+	if err != nil {
+		return nil, err
+	}
+	nextEnv["payload"] = payload
+	return json.Marshal(nextEnv)
+}
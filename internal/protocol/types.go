@@ -1,5 +1,7 @@
 package protocol
 
+// ProtocolVersion is the envelope version the relay works with internally
+// and the default for clients that do not negotiate one.
 const ProtocolVersion = 1
 
 // Message types
@@ -15,6 +17,12 @@ const (
 	TypePong        = "pong"
 	TypeStatus      = "status"
 	TypeKeyExchange = "key_exchange"
+	TypeAck         = "ack"
+	TypeDelivered   = "delivered"
+	TypePresenceSet = "presence.set"
+
+	// Session control
+	TypeSessionReplaced = "session.replaced"
 
 	// Agent management
 	TypeAgentList       = "agent.list"
@@ -46,14 +54,46 @@ const (
 	// System monitoring
 	TypeSystemStatus       = "system.status"
 	TypeSystemStatusResult = "system.status.result"
+	TypeSystemReconnect    = "system.reconnect"
+	TypeSystemNotice       = "system.notice"
+
+	// Ephemeral signals, see NamespaceEphemeral
+	TypeEphemeralTyping = "ephemeral.typing"
+
+	// File transfer
+	TypeFileOffer    = "file.offer"
+	TypeFileAccept   = "file.accept"
+	TypeFileChunk    = "file.chunk"
+	TypeFileAck      = "file.ack"
+	TypeFileComplete = "file.complete"
 )
 
+// NamespaceEphemeral prefixes message types the relay forwards best effort,
+// without queueing, replay or bandwidth accounting.
+const NamespaceEphemeral = "ephemeral."
+
 // Roles
 const (
 	RolePhone = "phone"
 	RoleAgent = "agent"
 )
 
+// DefaultDevice is the device ID assigned to clients that do not send one.
+const DefaultDevice = "default"
+
+// Peer presence states
+const (
+	StatusOnline  = "online"
+	StatusOffline = "offline"
+)
+
+// Presence states set with presence.set
+const (
+	PresenceAvailable = "available"
+	PresenceBusy      = "busy"
+	PresenceAway      = "away"
+)
+
 // Error codes
 const (
 	ErrUnauthorized         = "UNAUTHORIZED"
@@ -63,8 +103,23 @@ const (
 	ErrMonthlyQuotaExceeded = "MONTHLY_QUOTA_EXCEEDED"
 	ErrMessageTooLarge      = "MESSAGE_TOO_LARGE"
 	ErrInvalidMessage       = "INVALID_MESSAGE"
+	ErrNodeUnavailable      = "NODE_UNAVAILABLE"
+	ErrDraining             = "DRAINING"
+	ErrRequestTimeout       = "REQUEST_TIMEOUT"
+	ErrPeerDisconnected     = "PEER_DISCONNECTED"
+	ErrStreamInterrupted    = "STREAM_INTERRUPTED"
+	ErrSessionInUse         = "SESSION_IN_USE"
+	ErrExpired              = "EXPIRED"
+	ErrUnsupportedVersion   = "UNSUPPORTED_VERSION"
+	ErrFileTooLarge         = "FILE_TOO_LARGE"
+	ErrFileExceedsQuota     = "FILE_EXCEEDS_QUOTA"
 )
 
+// CloseReplaced is the WebSocket close code sent to a connection that another
+// connection for the same device took over. Clients should not reconnect
+// automatically after it.
+const CloseReplaced = 4001
+
 // Attachment types
 const (
 	AttachmentImage = "image"
@@ -78,6 +133,7 @@ type Attachment struct {
 
 type ChatSendPayload struct {
 	Text         string                 `json:"text"`
+	AgentID      string                 `json:"agent_id,omitempty"`
 	Attachments  []Attachment           `json:"attachments,omitempty"`
 	Model        string                 `json:"model,omitempty"`
 	Options      map[string]interface{} `json:"options,omitempty"`
@@ -90,13 +146,16 @@ type ConversationMsg struct {
 }
 
 type ChatStreamPayload struct {
-	Delta string `json:"delta"`
-	Seq   int    `json:"seq"`
+	Delta    string `json:"delta"`
+	Seq      int    `json:"seq"`
+	SeqStart int    `json:"seq_start,omitempty"` // first seq merged into this chunk
+	StreamID string `json:"stream_id,omitempty"`
 }
 
 type ChatDonePayload struct {
 	FullText string     `json:"full_text"`
 	Usage    *UsageInfo `json:"usage,omitempty"`
+	StreamID string     `json:"stream_id,omitempty"`
 }
 
 type UsageInfo struct {
@@ -105,22 +164,140 @@ type UsageInfo struct {
 }
 
 type AuthPayload struct {
-	Token string `json:"token"`
-	Role  string `json:"role"`
+	Token    string   `json:"token"`
+	Role     string   `json:"role"`
+	DeviceID string   `json:"device_id,omitempty"`
+	Agents   []string `json:"agents,omitempty"`   // agent IDs served (agent role)
+	LastSeq  uint64   `json:"last_seq,omitempty"` // resume after this relay sequence number
+	Receipts bool     `json:"receipts,omitempty"` // ask for delivered receipts
+	Client   string   `json:"client,omitempty"`   // client name and version, e.g. "coralmux-ios/1.4.2"
+	Platform string   `json:"platform,omitempty"` // e.g. "ios", "android", "macos"
+	Encoding string   `json:"encoding,omitempty"` // frames the relay sends: "json" (default) or "cbor"
+	Versions []int    `json:"versions,omitempty"` // protocol versions the client speaks
 }
 
 type AuthOkPayload struct {
-	Paired     bool  `json:"paired"`
-	DailyQuota int64 `json:"daily_quota_bytes,omitempty"`
-	DailyUsed  int64 `json:"daily_used_bytes,omitempty"`
+	Paired     bool           `json:"paired"`
+	DailyQuota int64          `json:"daily_quota_bytes,omitempty"`
+	DailyUsed  int64          `json:"daily_used_bytes,omitempty"`
+	LastSeq    uint64         `json:"last_seq,omitempty"`  // highest relay sequence number sent toward this role
+	Resumed    bool           `json:"resumed,omitempty"`   // every missed frame is being resent
+	Presence   []Presence     `json:"presence,omitempty"`  // last known presence of each peer device
+	DeviceID   string         `json:"device_id,omitempty"` // device ID the connection is registered under
+	Encoding   string         `json:"encoding,omitempty"`  // encoding of the frames the relay sends
+	Version    int            `json:"version"`             // negotiated protocol version
+	Transfers  []FileProgress `json:"transfers,omitempty"` // unfinished file transfers to resume
+}
+
+// DeliveredPayload is the relay's receipt that the envelope with ID was
+// written to the peer's socket.
+type DeliveredPayload struct {
+	ID string `json:"id"`
+}
+
+// AckPayload acknowledges every relay frame up to and including Seq.
+type AckPayload struct {
+	Seq uint64 `json:"seq"`
 }
 
 type StatusPayload struct {
-	Peer string `json:"peer"` // "online" | "offline"
+	Peer    string     `json:"peer"`              // "online" | "offline"
+	Device  string     `json:"device,omitempty"`  // peer device whose state changed
+	Devices []Presence `json:"devices,omitempty"` // every known peer device
+}
+
+// Presence describes a single device of the peer role.
+type Presence struct {
+	Device   string `json:"device"`
+	Status   string `json:"status"`              // "online" | "offline"
+	State    string `json:"state,omitempty"`     // "available" | "busy" | "away"
+	LastSeen int64  `json:"last_seen,omitempty"` // unix ms the device was last connected or changed state
+	Client   string `json:"client,omitempty"`
+	Platform string `json:"platform,omitempty"`
+}
+
+// TypingPayload is sent with ephemeral.typing while a user composes a message.
+type TypingPayload struct {
+	Active bool `json:"active"`
+}
+
+// PresenceSetPayload changes the sender's presence state.
+type PresenceSetPayload struct {
+	State string `json:"state"` // "available" | "busy" | "away"
+}
+
+// ReplacedPayload tells a connection that a newer connection for the same
+// device took over. The relay closes it with CloseReplaced.
+type ReplacedPayload struct {
+	Device   string `json:"device"`
+	Client   string `json:"client,omitempty"`   // client of the newcomer
+	Platform string `json:"platform,omitempty"` // platform of the newcomer
+}
+
+// ReconnectPayload asks a client to reconnect after BackoffMs because the
+// relay is shutting down.
+type ReconnectPayload struct {
+	BackoffMs int64  `json:"backoff_ms"`
+	Reason    string `json:"reason,omitempty"`
+}
+
+// NoticePayload is an operator announcement broadcast by the relay.
+type NoticePayload struct {
+	Message string `json:"message"`
+	Level   string `json:"level,omitempty"` // "info" | "warning"
+}
+
+// FileOfferPayload announces a file the sender wants to transfer. Offering a
+// known transfer ID again, e.g. after reconnecting, resumes that transfer.
+type FileOfferPayload struct {
+	TransferID string `json:"transfer_id"`
+	Name       string `json:"name"`
+	MimeType   string `json:"mime_type,omitempty"`
+	Size       int64  `json:"size"`
+	SHA256     string `json:"sha256"` // hex digest of the whole file
+}
+
+// FileAcceptPayload accepts an offer. Offset is where the receiver wants the
+// data to start, the bytes it already has when resuming.
+type FileAcceptPayload struct {
+	TransferID string `json:"transfer_id"`
+	Offset     int64  `json:"offset,omitempty"`
+}
+
+// FileChunkPayload carries the bytes of a file starting at Offset.
+type FileChunkPayload struct {
+	TransferID string `json:"transfer_id"`
+	Offset     int64  `json:"offset"`
+	DataB64    string `json:"data_b64"`
+	SHA256     string `json:"sha256,omitempty"` // hex digest of this chunk
+}
+
+// FileAckPayload confirms the receiver has the first Offset bytes.
+type FileAckPayload struct {
+	TransferID string `json:"transfer_id"`
+	Offset     int64  `json:"offset"`
+}
+
+// FileCompletePayload ends a transfer once every chunk was sent.
+type FileCompletePayload struct {
+	TransferID string `json:"transfer_id"`
+}
+
+// FileProgress describes an unfinished transfer in auth.ok.
+type FileProgress struct {
+	TransferID string `json:"transfer_id"`
+	Direction  string `json:"direction"` // "send" | "receive", seen from the client
+	Name       string `json:"name"`
+	Size       int64  `json:"size"`
+	Offset     int64  `json:"offset"` // bytes the receiver acknowledged
 }
 
 type ErrorPayload struct {
 	Code         string `json:"code"`
 	Message      string `json:"message"`
 	RetryAfterMs int64  `json:"retry_after_ms,omitempty"`
+	RequestID    string `json:"request_id,omitempty"` // request the relay gave up on
+	StreamID     string `json:"stream_id,omitempty"`  // stream that was interrupted
+	LastSeq      int    `json:"last_seq,omitempty"`   // last chunk seq the relay forwarded
+	Field        string `json:"field,omitempty"`      // payload field that failed validation
 }
@@ -0,0 +1,171 @@
+package protocol
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// payloadTypes maps message types to the struct their payload must decode
+// into. Types not listed here are not validated.
+var payloadTypes = map[string]reflect.Type{
+	TypeChatSend:        reflect.TypeOf(ChatSendPayload{}),
+	TypeChatStream:      reflect.TypeOf(ChatStreamPayload{}),
+	TypeChatDone:        reflect.TypeOf(ChatDonePayload{}),
+	TypeChatError:       reflect.TypeOf(ErrorPayload{}),
+	TypeAck:             reflect.TypeOf(AckPayload{}),
+	TypePresenceSet:     reflect.TypeOf(PresenceSetPayload{}),
+	TypeEphemeralTyping: reflect.TypeOf(TypingPayload{}),
+	TypeFileOffer:       reflect.TypeOf(FileOfferPayload{}),
+	TypeFileAccept:      reflect.TypeOf(FileAcceptPayload{}),
+	TypeFileChunk:       reflect.TypeOf(FileChunkPayload{}),
+	TypeFileAck:         reflect.TypeOf(FileAckPayload{}),
+	TypeFileComplete:    reflect.TypeOf(FileCompletePayload{}),
+}
+
+// ValidationError reports the payload field that failed validation.
+type ValidationError struct {
+	Field  string // dotted path, e.g. "payload.attachments[0].mime_type"
+	Reason string
+}
+
+func (e *ValidationError) Error() string {
+	return e.Field + ": " + e.Reason
+}
+
+// ValidatePayload checks an envelope's payload against the struct defined for
+// its type: every field is of the right JSON type and every field whose tag
+// lacks omitempty is present. Encrypted payloads and types without a struct
+// pass; unknown fields are allowed. Failures are *ValidationError.
+func ValidatePayload(env *Envelope) error {
+	t, ok := payloadTypes[env.Type]
+	if !ok || env.Encrypted() {
+		return nil
+	}
+	var value interface{}
+	if err := json.Unmarshal(env.Payload, &value); err != nil {
+		return &ValidationError{Field: "payload", Reason: "invalid JSON"}
+	}
+	if value == nil {
+		return &ValidationError{Field: "payload", Reason: "required"}
+	}
+	return validateValue("payload", t, value)
+}
+
+func validateValue(path string, t reflect.Type, value interface{}) error {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if value == nil {
+		// null is the zero value for any field
+		return nil
+	}
+	switch t.Kind() {
+	case reflect.Struct:
+		fields, ok := value.(map[string]interface{})
+		if !ok {
+			return mismatch(path, "object", value)
+		}
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			name, omitempty := jsonName(f)
+			if name == "" {
+				continue
+			}
+			v, present := fields[name]
+			if (!present || v == nil) && !omitempty {
+				return &ValidationError{Field: path + "." + name, Reason: "required"}
+			}
+			if err := validateValue(path+"."+name, f.Type, v); err != nil {
+				return err
+			}
+		}
+	case reflect.Slice:
+		items, ok := value.([]interface{})
+		if !ok {
+			return mismatch(path, "array", value)
+		}
+		for i, item := range items {
+			if err := validateValue(fmt.Sprintf("%s[%d]", path, i), t.Elem(), item); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		entries, ok := value.(map[string]interface{})
+		if !ok {
+			return mismatch(path, "object", value)
+		}
+		for k, item := range entries {
+			if err := validateValue(path+"."+k, t.Elem(), item); err != nil {
+				return err
+			}
+		}
+	case reflect.String:
+		if _, ok := value.(string); !ok {
+			return mismatch(path, "string", value)
+		}
+	case reflect.Bool:
+		if _, ok := value.(bool); !ok {
+			return mismatch(path, "boolean", value)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, ok := value.(float64)
+		if !ok {
+			return mismatch(path, "integer", value)
+		}
+		if n != float64(int64(n)) || (n < 0 && t.Kind() >= reflect.Uint) {
+			return &ValidationError{Field: path, Reason: fmt.Sprintf("expected %s, got %v", integerName(t), n)}
+		}
+	case reflect.Float32, reflect.Float64:
+		if _, ok := value.(float64); !ok {
+			return mismatch(path, "number", value)
+		}
+	}
+	return nil
+}
+
+// jsonName returns the JSON key of a struct field and whether it may be
+// omitted. The name is empty for fields encoding/json skips.
+func jsonName(f reflect.StructField) (string, bool) {
+	if !f.IsExported() {
+		return "", false
+	}
+	tag := f.Tag.Get("json")
+	if tag == "-" {
+		return "", false
+	}
+	name, opts, _ := strings.Cut(tag, ",")
+	if name == "" {
+		name = f.Name
+	}
+	return name, strings.Contains(","+opts+",", ",omitempty,")
+}
+
+func integerName(t reflect.Type) string {
+	if t.Kind() >= reflect.Uint {
+		return "non-negative integer"
+	}
+	return "integer"
+}
+
+func mismatch(path, want string, value interface{}) error {
+	return &ValidationError{Field: path, Reason: fmt.Sprintf("expected %s, got %s", want, jsonKind(value))}
+}
+
+func jsonKind(value interface{}) string {
+	switch value.(type) {
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	case string:
+		return "string"
+	case float64:
+		return "number"
+	case bool:
+		return "boolean"
+	}
+	return "null"
+}
@@ -0,0 +1,88 @@
+package protocol
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// SupportedVersions lists the protocol versions the relay speaks, oldest
+// first. Version 2 moves the relay's routing fields out of the top level of
+// the envelope into a "meta" object.
+var SupportedVersions = []int{1, 2}
+
+// metaFields are the envelope fields version 2 nests under "meta".
+var metaFields = []string{"device", "rseq", "reply_to", "ttl_ms"}
+
+// NegotiateVersion picks the newest version both sides speak. Clients that
+// list no versions get the version of their auth envelope, or 1 if unset.
+// It returns false if there is no common version.
+func NegotiateVersion(versions []int, v int) (int, bool) {
+	if len(versions) == 0 {
+		if v == 0 {
+			v = ProtocolVersion
+		}
+		versions = []int{v}
+	}
+	best := 0
+	for _, want := range versions {
+		for _, have := range SupportedVersions {
+			if want == have && want > best {
+				best = want
+			}
+		}
+	}
+	return best, best != 0
+}
+
+// ToVersion converts a version 1 envelope, the relay's internal form, to
+// version v.
+func ToVersion(raw []byte, v int) ([]byte, error) {
+	if v == ProtocolVersion {
+		return raw, nil
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return nil, err
+	}
+	meta := make(map[string]json.RawMessage)
+	for _, key := range metaFields {
+		if value, ok := fields[key]; ok {
+			meta[key] = value
+			delete(fields, key)
+		}
+	}
+	if len(meta) > 0 {
+		data, err := json.Marshal(meta)
+		if err != nil {
+			return nil, err
+		}
+		fields["meta"] = data
+	}
+	fields["v"] = json.RawMessage(fmt.Sprint(v))
+	return json.Marshal(fields)
+}
+
+// FromVersion converts a version v envelope to version 1.
+func FromVersion(raw []byte, v int) ([]byte, error) {
+	if v == ProtocolVersion {
+		return raw, nil
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return nil, err
+	}
+	if data, ok := fields["meta"]; ok {
+		var meta map[string]json.RawMessage
+		if err := json.Unmarshal(data, &meta); err != nil {
+			return nil, fmt.Errorf("meta: %w", err)
+		}
+		for _, key := range metaFields {
+			if value, ok := meta[key]; ok {
+				fields[key] = value
+			}
+		}
+		delete(fields, "meta")
+	}
+	fields["v"] = json.RawMessage(fmt.Sprint(ProtocolVersion))
+	return json.Marshal(fields)
+}
@@ -8,6 +8,8 @@ const (
 	PhoneMessagesPerMinute = 30
 	AgentMessagesPerMinute = 120
 	MaxMessageSize         = 5 * 1024 * 1024 // 5MB
+	// MaxEphemeralSize bounds ephemeral messages, which are not metered.
+	MaxEphemeralSize = 4 * 1024 // 4KB
 )
 
 // NewPhoneLimiter creates a rate limiter for phone connections.
@@ -41,3 +41,17 @@ func (q *QuotaChecker) Check(token string) (string, error) {
 func (q *QuotaChecker) Record(token string, bytes int64) error {
 	return q.store.RecordBytes(token, bytes)
 }
+
+// Remaining returns the bytes a token may still use before reaching its
+// daily or monthly quota, whichever is closer.
+func (q *QuotaChecker) Remaining(token string) (int64, error) {
+	daily, err := q.store.GetDailyUsage(token)
+	if err != nil {
+		return 0, err
+	}
+	monthly, err := q.store.GetMonthlyUsage(token)
+	if err != nil {
+		return 0, err
+	}
+	return max(0, min(DailyQuotaBytes-daily, MonthlyQuotaBytes-monthly)), nil
+}
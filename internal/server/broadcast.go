@@ -0,0 +1,101 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/openclaw/openclaw-relay/internal/hub"
+	"github.com/openclaw/openclaw-relay/internal/protocol"
+)
+
+// broadcastRequest is the body of POST /api/v1/broadcast.
+type broadcastRequest struct {
+	Message string   `json:"message"`
+	Level   string   `json:"level,omitempty"`
+	Tokens  []string `json:"tokens,omitempty"` // empty = every session
+	Role    string   `json:"role,omitempty"`   // empty = both roles
+}
+
+// peerTimeout bounds each call to another cluster node.
+const peerTimeout = 5 * time.Second
+
+// handleBroadcast pushes a system.notice to connected clients and reports
+// how many it reached. In a cluster the request is passed on to every other
+// node, with the caller's admin key, and the counts are summed.
+func (s *Server) handleBroadcast(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Requests from peers still need the admin key; the signature only
+	// tells that the broadcast must not be passed on again
+	fromPeer := s.config.Cluster != nil && s.config.Cluster.Verify(r) == nil
+	if !s.checkAdmin(r) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, 64*1024))
+	if err != nil {
+		http.Error(w, "Failed to read body", http.StatusBadRequest)
+		return
+	}
+	var req broadcastRequest
+	if err := json.Unmarshal(body, &req); err != nil || req.Message == "" {
+		http.Error(w, "Message required", http.StatusBadRequest)
+		return
+	}
+	if req.Role != "" && req.Role != protocol.RolePhone && req.Role != protocol.RoleAgent {
+		http.Error(w, "Invalid role", http.StatusBadRequest)
+		return
+	}
+
+	result, err := s.hub.Broadcast(
+		protocol.NoticePayload{Message: req.Message, Level: req.Level},
+		hub.BroadcastFilter{Tokens: req.Tokens, Role: req.Role},
+	)
+	if err != nil {
+		http.Error(w, "Failed to broadcast", http.StatusInternalServerError)
+		return
+	}
+	if s.config.Cluster != nil && !fromPeer {
+		result = result.Add(s.broadcastPeers(r.URL.Path, body, r.Header.Get("X-Admin-Key")))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// broadcastPeers repeats a broadcast on every other cluster node and sums
+// what they report. Nodes that fail are logged and skipped.
+func (s *Server) broadcastPeers(path string, body []byte, adminKey string) hub.BroadcastResult {
+	var total hub.BroadcastResult
+	client := &http.Client{Timeout: peerTimeout}
+	for _, node := range s.config.Cluster.Peers() {
+		req, err := s.config.Cluster.NewRequest(http.MethodPost, node, path, bytes.NewReader(body))
+		if err != nil {
+			log.Printf("broadcast to %s: %v", node, err)
+			continue
+		}
+		req.Header.Set("X-Admin-Key", adminKey)
+		resp, err := client.Do(req)
+		if err != nil {
+			log.Printf("broadcast to %s: %v", node, err)
+			continue
+		}
+		var result hub.BroadcastResult
+		err = json.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil || resp.StatusCode != http.StatusOK {
+			log.Printf("broadcast to %s: status %d: %v", node, resp.StatusCode, err)
+			continue
+		}
+		total = total.Add(result)
+	}
+	return total
+}
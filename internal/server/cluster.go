@@ -0,0 +1,125 @@
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/openclaw/openclaw-relay/internal/cluster"
+	"github.com/openclaw/openclaw-relay/internal/hub"
+	"github.com/openclaw/openclaw-relay/internal/protocol"
+)
+
+// routeConnection reads a client's auth frame and serves the connection
+// here if this node owns its token, or proxies it to the owning node.
+func (s *Server) routeConnection(ws *websocket.Conn, deflate *hub.Compression) {
+	raw, err := readAuth(ws)
+	if err != nil {
+		log.Printf("read auth error: %v", err)
+		ws.Close()
+		return
+	}
+
+	c := s.config.Cluster
+	token := authToken(raw)
+	if token == "" || c.Owns(token) {
+		serveConnection(s.hub, ws, raw, deflate)
+		return
+	}
+
+	// The owner meters the client by what this node sends it
+	owner := c.Owner(token)
+	query := url.Values{}
+	compressAt := 0
+	if deflate != nil {
+		query.Set("deflate_level", strconv.Itoa(deflate.Level))
+		query.Set("deflate_threshold", strconv.Itoa(deflate.Threshold))
+		compressAt = deflate.Threshold
+	}
+	upstream, err := c.Dial(owner, raw, query)
+	if err != nil {
+		log.Printf("cluster link to %s failed: %v", owner, err)
+		sendAuthFail(ws, protocol.ErrNodeUnavailable, "Session node unavailable")
+		ws.Close()
+		return
+	}
+	s.linksMu.Lock()
+	s.links[ws] = struct{}{}
+	s.linksMu.Unlock()
+	cluster.Pipe(ws, upstream, compressAt)
+	s.linksMu.Lock()
+	delete(s.links, ws)
+	s.linksMu.Unlock()
+}
+
+// closeLinks closes the connections this node proxies to other nodes, so
+// their clients reconnect through another node.
+func (s *Server) closeLinks() {
+	s.linksMu.Lock()
+	defer s.linksMu.Unlock()
+	for ws := range s.links {
+		ws.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseServiceRestart, "relay restarting"),
+			time.Now().Add(writeWait))
+		ws.Close()
+	}
+}
+
+// authToken extracts the pairing token from an auth frame, or "" if the
+// frame is not a valid auth message.
+func authToken(raw []byte) string {
+	var env protocol.Envelope
+	if err := json.Unmarshal(raw, &env); err != nil || env.Type != protocol.TypeAuth {
+		return ""
+	}
+	var auth protocol.AuthPayload
+	if err := env.ParsePayload(&auth); err != nil {
+		return ""
+	}
+	return auth.Token
+}
+
+// handleClusterLink accepts a client connection forwarded by another node.
+// The owner serves it like a direct connection, metered with the compression
+// the client negotiated with the forwarding node.
+func (s *Server) handleClusterLink(w http.ResponseWriter, r *http.Request) {
+	if err := s.config.Cluster.Verify(r); err != nil {
+		log.Printf("cluster link rejected from %s: %v", r.RemoteAddr, err)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("cluster link upgrade error: %v", err)
+		return
+	}
+	go HandleConnection(s.hub, ws, linkCompression(r.URL.Query()))
+}
+
+// linkCompression returns the compression a forwarded client negotiated, as
+// described by the link's query, or nil if it has none.
+func linkCompression(query url.Values) *hub.Compression {
+	level, err := strconv.Atoi(query.Get("deflate_level"))
+	if err != nil {
+		return nil
+	}
+	threshold, _ := strconv.Atoi(query.Get("deflate_threshold"))
+	return &hub.Compression{Level: level, Threshold: threshold}
+}
+
+// forwardToOwner proxies a token API request to the node that owns the
+// token. It returns false if the request should be served here, because
+// clustering is off, this node owns the token, or the request was already
+// forwarded by a peer.
+func (s *Server) forwardToOwner(w http.ResponseWriter, r *http.Request, token string) bool {
+	c := s.config.Cluster
+	if c == nil || c.Owns(token) || c.Verify(r) == nil {
+		return false
+	}
+	c.Forward(w, r, c.Owner(token))
+	return true
+}
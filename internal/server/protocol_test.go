@@ -0,0 +1,69 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/openclaw/openclaw-relay/internal/hub"
+	"github.com/openclaw/openclaw-relay/internal/protocol"
+	"github.com/openclaw/openclaw-relay/internal/store"
+)
+
+func TestProtocolEndpoint(t *testing.T) {
+	db, err := store.NewSQLiteStore(filepath.Join(t.TempDir(), "relay.db"))
+	if err != nil {
+		t.Fatalf("NewSQLiteStore: %v", err)
+	}
+	defer db.Close()
+	handler := New(hub.NewHub(db), Config{Version: "test"}).Handler()
+	request := func(method, query string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(method, "/api/v1/protocol"+query, nil))
+		return rec
+	}
+
+	for query, want := range map[string]int{
+		"":           protocol.ProtocolVersion,
+		"?version=2": 2,
+	} {
+		rec := request(http.MethodGet, query)
+		var doc struct {
+			AsyncAPI string `json:"asyncapi"`
+			Info     struct {
+				Version         string `json:"version"`
+				ProtocolVersion int    `json:"x-protocol-version"`
+			} `json:"info"`
+			Components struct {
+				Messages map[string]json.RawMessage `json:"messages"`
+			} `json:"components"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &doc); err != nil || rec.Code != http.StatusOK {
+			t.Fatalf("GET %s: status %d, %v", query, rec.Code, err)
+		}
+		if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+			t.Fatalf("GET %s: content type %q", query, ct)
+		}
+		if doc.AsyncAPI != protocol.AsyncAPIVersion || doc.Info.Version != "test" || doc.Info.ProtocolVersion != want {
+			t.Fatalf("GET %s: asyncapi %q, relay %q, protocol version %d", query, doc.AsyncAPI, doc.Info.Version, doc.Info.ProtocolVersion)
+		}
+		if _, ok := doc.Components.Messages[protocol.TypeChatSend]; !ok {
+			t.Fatalf("GET %s: chat.send missing", query)
+		}
+	}
+
+	for _, tc := range []struct {
+		method, query string
+		want          int
+	}{
+		{http.MethodGet, "?version=99", http.StatusNotFound},
+		{http.MethodGet, "?version=two", http.StatusBadRequest},
+		{http.MethodPost, "", http.StatusMethodNotAllowed},
+	} {
+		if rec := request(tc.method, tc.query); rec.Code != tc.want {
+			t.Fatalf("%s %s: status %d, want %d", tc.method, tc.query, rec.Code, tc.want)
+		}
+	}
+}
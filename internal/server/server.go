@@ -4,6 +4,7 @@ import (
 	"context"
 	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"log"
 	"net/http"
 	"runtime"
@@ -12,6 +13,7 @@ import (
 	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/openclaw/openclaw-relay/internal/cluster"
 	"github.com/openclaw/openclaw-relay/internal/hub"
 	"golang.org/x/crypto/acme/autocert"
 )
@@ -28,6 +30,16 @@ type Config struct {
 	TLSDomain string
 	AdminKey  string
 	DBPath    string
+	// Cluster, if set, routes each token to the node that owns it.
+	Cluster *cluster.Cluster
+	// DrainTimeout is how long Shutdown waits for in-flight chat streams
+	// before closing connections.
+	DrainTimeout time.Duration
+	// Compression, if set, enables permessage-deflate for clients that
+	// offer it.
+	Compression *hub.Compression
+	// Version is the relay build reported in the protocol specification.
+	Version string
 }
 
 // Server is the relay HTTP/WebSocket server.
@@ -36,6 +48,9 @@ type Server struct {
 	config    Config
 	http      *http.Server
 	regLimiter *ipRateLimiter
+
+	linksMu sync.Mutex
+	links   map[*websocket.Conn]struct{} // clients proxied to other nodes
 }
 
 // ipRateLimiter tracks registration attempts per IP.
@@ -75,6 +90,7 @@ func New(h *hub.Hub, cfg Config) *Server {
 		hub:        h,
 		config:     cfg,
 		regLimiter: newIPRateLimiter(5, time.Hour), // 5 registrations per hour per IP
+		links:      make(map[*websocket.Conn]struct{}),
 	}
 
 	mux := http.NewServeMux()
@@ -83,6 +99,11 @@ func New(h *hub.Hub, cfg Config) *Server {
 	mux.HandleFunc("/api/v1/pair", s.handlePair)
 	mux.HandleFunc("/api/v1/pair/", s.handlePairToken)
 	mux.HandleFunc("/api/v1/register", s.handleRegister)
+	mux.HandleFunc("/api/v1/broadcast", s.handleBroadcast)
+	mux.HandleFunc("/api/v1/protocol", s.handleProtocol)
+	if cfg.Cluster != nil {
+		mux.HandleFunc(cluster.LinkPath, s.handleClusterLink)
+	}
 
 	s.http = &http.Server{
 		Addr:    cfg.Addr,
@@ -92,6 +113,11 @@ func New(h *hub.Hub, cfg Config) *Server {
 	return s
 }
 
+// Handler returns the server's HTTP handler.
+func (s *Server) Handler() http.Handler {
+	return s.http.Handler
+}
+
 func (s *Server) Start() error {
 	log.Printf("Relay server starting on %s", s.config.Addr)
 
@@ -119,18 +145,51 @@ func (s *Server) Start() error {
 	return s.http.ListenAndServe()
 }
 
+// Shutdown stops accepting connections, then drains the hub: clients are
+// told to reconnect, in-flight streams get up to DrainTimeout to finish, and
+// every socket is closed with a service restart close code.
 func (s *Server) Shutdown(ctx context.Context) error {
 	log.Printf("Graceful shutdown initiated")
-	return s.http.Shutdown(ctx)
+	// http.Server does not track upgraded WebSockets, so this only stops
+	// new connections
+	err := s.http.Shutdown(ctx)
+	s.hub.Drain(ctx, time.Now().Add(s.config.DrainTimeout))
+	s.closeLinks()
+	return err
 }
 
 func (s *Server) handleWS(w http.ResponseWriter, r *http.Request) {
-	ws, err := upgrader.Upgrade(w, r, nil)
+	u := upgrader
+	u.EnableCompression = s.config.Compression != nil
+	ws, err := u.Upgrade(w, r, nil)
 	if err != nil {
 		log.Printf("ws upgrade error: %v", err)
 		return
 	}
-	go HandleConnection(s.hub, ws)
+	var deflate *hub.Compression
+	if u.EnableCompression && offersDeflate(r) {
+		deflate = s.config.Compression
+		ws.SetCompressionLevel(deflate.Level)
+	}
+	if s.config.Cluster != nil {
+		go s.routeConnection(ws, deflate)
+		return
+	}
+	go HandleConnection(s.hub, ws, deflate)
+}
+
+// offersDeflate reports whether the client offered permessage-deflate, which
+// the upgrader then accepts.
+func offersDeflate(r *http.Request) bool {
+	for _, header := range r.Header.Values("Sec-WebSocket-Extensions") {
+		for _, ext := range strings.Split(header, ",") {
+			name, _, _ := strings.Cut(ext, ";")
+			if strings.TrimSpace(name) == "permessage-deflate" {
+				return true
+			}
+		}
+	}
+	return false
 }
 
 func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
@@ -146,6 +205,10 @@ func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
 		"alloc_mb":     float64(memStats.Alloc) / 1024 / 1024,
 		"sys_mb":       float64(memStats.Sys) / 1024 / 1024,
 		"goroutines":   runtime.NumGoroutine(),
+		"dropped_frames": map[string]int64{
+			hub.LaneControl.String(): s.hub.DroppedFrames(hub.LaneControl),
+			hub.LaneBulk.String():    s.hub.DroppedFrames(hub.LaneBulk),
+		},
 	})
 }
 
@@ -177,16 +240,42 @@ func (s *Server) handlePairToken(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Token required", http.StatusBadRequest)
 		return
 	}
+	if s.forwardToOwner(w, r, token) {
+		return
+	}
 
 	switch r.Method {
 	case http.MethodGet:
 		phone, agent := s.hub.GetTokenStatus(token)
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]bool{
-			"phone": phone,
-			"agent": agent,
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"phone":    phone,
+			"agent":    agent,
+			"takeover": s.hub.TakeoverPolicy(token),
 		})
 
+	case http.MethodPut:
+		if !s.checkAdmin(r) {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		var settings struct {
+			Takeover string `json:"takeover"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&settings); err != nil || !hub.ValidTakeover(settings.Takeover) {
+			http.Error(w, "Invalid takeover policy", http.StatusBadRequest)
+			return
+		}
+		if err := s.hub.SetTakeoverPolicy(token, settings.Takeover); err != nil {
+			if errors.Is(err, hub.ErrInvalidToken) {
+				http.Error(w, "Token not found", http.StatusNotFound)
+				return
+			}
+			http.Error(w, "Failed to update token", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
 	case http.MethodDelete:
 		if !s.checkAdmin(r) {
 			http.Error(w, "Unauthorized", http.StatusUnauthorized)
@@ -2,6 +2,7 @@ package server
 
 import (
 	"encoding/json"
+	"errors"
 	"log"
 	"time"
 
@@ -19,25 +20,42 @@ const (
 )
 
 // HandleConnection manages the lifecycle of a single WebSocket connection.
-func HandleConnection(h *hub.Hub, ws *websocket.Conn) {
-	conn := hub.NewConnection(ws, "", nil)
-	defer ws.Close()
+// deflate is set if the connection negotiated permessage-deflate.
+func HandleConnection(h *hub.Hub, ws *websocket.Conn, deflate *hub.Compression) {
+	// First message must be auth
+	raw, err := readAuth(ws)
+	if err != nil {
+		log.Printf("read auth error: %v", err)
+		ws.Close()
+		return
+	}
+	serveConnection(h, ws, raw, deflate)
+}
 
+// readAuth reads a new connection's first frame, as JSON.
+func readAuth(ws *websocket.Conn) ([]byte, error) {
 	ws.SetReadLimit(int64(maxMessageSize))
 	ws.SetReadDeadline(time.Now().Add(pongWait))
+	msgType, raw, err := ws.ReadMessage()
+	if err == nil && msgType == websocket.BinaryMessage {
+		raw, err = protocol.DecodeBinary(raw)
+	}
+	return raw, err
+}
+
+// serveConnection authenticates a connection with its first frame and runs
+// it until it disconnects.
+func serveConnection(h *hub.Hub, ws *websocket.Conn, raw []byte, deflate *hub.Compression) {
+	conn := hub.NewConnection(ws, "", nil)
+	conn.Deflate = deflate
+	defer ws.Close()
+
 	ws.SetPongHandler(func(string) error {
 		ws.SetReadDeadline(time.Now().Add(pongWait))
 		conn.LastPing = time.Now()
 		return nil
 	})
 
-	// First message must be auth
-	_, raw, err := ws.ReadMessage()
-	if err != nil {
-		log.Printf("read auth error: %v", err)
-		return
-	}
-
 	var env protocol.Envelope
 	if err := json.Unmarshal(raw, &env); err != nil {
 		sendError(ws, protocol.ErrInvalidMessage, "Invalid JSON")
@@ -51,20 +69,16 @@ func HandleConnection(h *hub.Hub, ws *websocket.Conn) {
 
 	session, err := h.Authenticate(conn, &env)
 	if err != nil {
-		authFail, envErr := protocol.NewEnvelope(protocol.TypeAuthFail, protocol.ErrorPayload{
-			Code:    protocol.ErrUnauthorized,
-			Message: err.Error(),
-		})
-		if envErr != nil {
-			log.Printf("error creating auth fail envelope: %v", envErr)
-			return
+		code := protocol.ErrUnauthorized
+		switch {
+		case errors.Is(err, hub.ErrDraining):
+			code = protocol.ErrDraining
+		case errors.Is(err, hub.ErrSessionInUse):
+			code = protocol.ErrSessionInUse
+		case errors.Is(err, hub.ErrUnsupportedVersion):
+			code = protocol.ErrUnsupportedVersion
 		}
-		data, marshalErr := authFail.Marshal()
-		if marshalErr != nil {
-			log.Printf("error marshaling auth fail: %v", marshalErr)
-			return
-		}
-		ws.WriteMessage(websocket.TextMessage, data)
+		sendAuthFail(ws, code, err.Error())
 		return
 	}
 
@@ -72,10 +86,7 @@ func HandleConnection(h *hub.Hub, ws *websocket.Conn) {
 	defer h.Disconnect(session, conn)
 
 	// Send auth.ok
-	paired := session.IsPaired()
-	authOk, envErr := protocol.NewEnvelope(protocol.TypeAuthOk, protocol.AuthOkPayload{
-		Paired: paired,
-	})
+	authOk, envErr := protocol.NewEnvelope(protocol.TypeAuthOk, h.AuthOk(session, conn))
 	if envErr != nil {
 		log.Printf("error creating auth ok envelope: %v", envErr)
 		return
@@ -85,32 +96,19 @@ func HandleConnection(h *hub.Hub, ws *websocket.Conn) {
 		log.Printf("error marshaling auth ok: %v", marshalErr)
 		return
 	}
-	ws.WriteMessage(websocket.TextMessage, data)
+	writeFrame(conn, conn.Encode(hub.Frame{Data: data}))
 
-	// Notify peer if now paired
-	if paired {
-		peer := session.PeerConn(conn.Role)
-		if peer != nil {
-			statusEnv, err := protocol.NewEnvelope(protocol.TypeStatus, protocol.StatusPayload{Peer: "online"})
-			if err != nil {
-				log.Printf("error creating online status: %v", err)
-			} else {
-				statusData, err := statusEnv.Marshal()
-				if err != nil {
-					log.Printf("error marshaling online status: %v", err)
-				} else {
-					select {
-					case peer.Send <- statusData:
-					default:
-					}
-				}
-			}
-		}
-	}
+	// Notify peers that this connection is online
+	h.NotifyOnline(session, conn)
 
 	// Start write pump
 	go writePump(conn)
 
+	// Resend frames a resuming client missed, then anything queued while
+	// this role was offline; frames forwarded meanwhile wait behind them
+	h.Resume(session, conn)
+	h.DeliverQueued(session, conn)
+
 	// Read pump (blocking)
 	readPump(h, session, conn)
 }
@@ -118,7 +116,7 @@ func HandleConnection(h *hub.Hub, ws *websocket.Conn) {
 func readPump(h *hub.Hub, session *hub.Session, conn *hub.Connection) {
 	for {
 		conn.WS.SetReadDeadline(time.Now().Add(pongWait))
-		_, raw, err := conn.WS.ReadMessage()
+		msgType, frame, err := conn.WS.ReadMessage()
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
 				log.Printf("ws read error: %v", err)
@@ -126,21 +124,28 @@ func readPump(h *hub.Hub, session *hub.Session, conn *hub.Connection) {
 			return
 		}
 
+		raw, err := conn.Decode(frame, msgType == websocket.BinaryMessage)
+		if err != nil {
+			queueError(conn, protocol.ErrInvalidMessage, "Invalid message: "+err.Error())
+			continue
+		}
+
 		var env protocol.Envelope
 		if err := json.Unmarshal(raw, &env); err != nil {
 			// Send error back for malformed JSON
-			sendError(conn.WS, protocol.ErrInvalidMessage, "Invalid JSON message")
+			queueError(conn, protocol.ErrInvalidMessage, "Invalid JSON message")
 			continue
 		}
 
-		// Role-based message validation
-		if conn.Role == protocol.RolePhone {
-			switch env.Type {
-			case protocol.TypeChatStream, protocol.TypeChatDone:
-				// Phone cannot send streaming messages
-				sendError(conn.WS, protocol.ErrInvalidMessage, "Phone cannot send stream messages")
-				continue
-			}
+		route, err := h.Route(conn.Role, env.Type)
+		if err != nil {
+			queueError(conn, protocol.ErrInvalidMessage, err.Error())
+			continue
+		}
+
+		if route.Target == protocol.TargetPeer {
+			h.Forward(&hub.Message{Session: session, Sender: conn, Env: &env, Raw: raw, Size: len(frame)})
+			continue
 		}
 
 		switch env.Type {
@@ -155,17 +160,13 @@ func readPump(h *hub.Hub, session *hub.Session, conn *hub.Connection) {
 				log.Printf("error marshaling pong: %v", err)
 				continue
 			}
-			select {
-			case conn.Send <- data:
-			default:
-			}
+			conn.Enqueue(hub.Frame{Data: data, Lane: hub.LaneControl})
 
-		case protocol.TypeChatSend, protocol.TypeChatStream, protocol.TypeChatDone, protocol.TypeChatError, protocol.TypeKeyExchange,
-			protocol.TypeAgentList, protocol.TypeAgentListResult, protocol.TypeAgentCreate, protocol.TypeAgentUpdate, protocol.TypeAgentDelete, protocol.TypeAgentResult,
-			protocol.TypeChatHistory, protocol.TypeChatHistoryResult,
-			protocol.TypeChatToolStatus,
-			protocol.TypeMemorySearch, protocol.TypeMemorySearchResult:
-			h.ForwardMessage(session, conn, raw)
+		case protocol.TypeAck:
+			h.Ack(session, conn, &env)
+
+		case protocol.TypePresenceSet:
+			h.SetPresence(session, conn, &env)
 		}
 	}
 }
@@ -176,13 +177,8 @@ func writePump(conn *hub.Connection) {
 
 	for {
 		select {
-		case msg, ok := <-conn.Send:
-			conn.WS.SetWriteDeadline(time.Now().Add(writeWait))
-			if !ok {
-				conn.WS.WriteMessage(websocket.CloseMessage, []byte{})
-				return
-			}
-			if err := conn.WS.WriteMessage(websocket.TextMessage, msg); err != nil {
+		case <-conn.Ready():
+			if err := writeQueued(conn); err != nil {
 				return
 			}
 
@@ -193,11 +189,48 @@ func writePump(conn *hub.Connection) {
 			}
 
 		case <-conn.Done:
+			if code, text := conn.CloseCode(); code != 0 {
+				// Flush what is queued, then close the socket cleanly so the
+				// read pump returns
+				writeQueued(conn)
+				conn.WS.WriteControl(websocket.CloseMessage,
+					websocket.FormatCloseMessage(code, text), time.Now().Add(writeWait))
+				conn.WS.Close()
+			}
 			return
 		}
 	}
 }
 
+// writeQueued writes every queued frame to the socket.
+func writeQueued(conn *hub.Connection) error {
+	for {
+		frame, ok := conn.Next()
+		if !ok {
+			return nil
+		}
+		if err := writeFrame(conn, conn.Encode(frame)); err != nil {
+			return err
+		}
+		if frame.OnWritten != nil {
+			frame.OnWritten()
+		}
+	}
+}
+
+// writeFrame writes an encoded frame as a text or binary message.
+func writeFrame(conn *hub.Connection, frame hub.Frame) error {
+	msgType := websocket.TextMessage
+	if frame.Binary {
+		msgType = websocket.BinaryMessage
+	}
+	if conn.Deflate != nil {
+		conn.WS.EnableWriteCompression(conn.Compresses(len(frame.Data)))
+	}
+	conn.WS.SetWriteDeadline(time.Now().Add(writeWait))
+	return conn.WS.WriteMessage(msgType, frame.Data)
+}
+
 func sendError(ws *websocket.Conn, code, message string) {
 	env, err := protocol.NewEnvelope(protocol.TypeChatError, protocol.ErrorPayload{
 		Code:    code,
@@ -214,3 +247,39 @@ func sendError(ws *websocket.Conn, code, message string) {
 	}
 	ws.WriteMessage(websocket.TextMessage, data)
 }
+
+// queueError sends a chat.error to an authenticated connection through its
+// write pump, in the connection's encoding.
+func queueError(conn *hub.Connection, code, message string) {
+	env, err := protocol.NewEnvelope(protocol.TypeChatError, protocol.ErrorPayload{
+		Code:    code,
+		Message: message,
+	})
+	if err != nil {
+		log.Printf("error creating error envelope: %v", err)
+		return
+	}
+	data, err := env.Marshal()
+	if err != nil {
+		log.Printf("error marshaling error envelope: %v", err)
+		return
+	}
+	conn.Enqueue(hub.Frame{Data: data, Lane: hub.LaneControl})
+}
+
+func sendAuthFail(ws *websocket.Conn, code, message string) {
+	env, err := protocol.NewEnvelope(protocol.TypeAuthFail, protocol.ErrorPayload{
+		Code:    code,
+		Message: message,
+	})
+	if err != nil {
+		log.Printf("error creating auth fail envelope: %v", err)
+		return
+	}
+	data, err := env.Marshal()
+	if err != nil {
+		log.Printf("error marshaling auth fail: %v", err)
+		return
+	}
+	ws.WriteMessage(websocket.TextMessage, data)
+}
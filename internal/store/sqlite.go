@@ -42,6 +42,21 @@ func migrate(db *sql.DB) error {
 			FOREIGN KEY (token) REFERENCES tokens(token) ON DELETE CASCADE
 		)`,
 		`CREATE INDEX IF NOT EXISTS idx_bandwidth_token_date ON bandwidth(token, recorded_at)`,
+		`CREATE TABLE IF NOT EXISTS mailbox (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			token TEXT NOT NULL,
+			role TEXT NOT NULL,
+			device TEXT NOT NULL DEFAULT '',
+			data BLOB NOT NULL,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (token) REFERENCES tokens(token) ON DELETE CASCADE
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_mailbox_token_role ON mailbox(token, role, id)`,
+		`CREATE TABLE IF NOT EXISTS token_policies (
+			token TEXT PRIMARY KEY,
+			takeover TEXT NOT NULL DEFAULT '',
+			FOREIGN KEY (token) REFERENCES tokens(token) ON DELETE CASCADE
+		)`,
 	}
 	for _, stmt := range stmts {
 		if _, err := db.Exec(stmt); err != nil {
@@ -128,6 +143,73 @@ func (s *SQLiteStore) ResetDailyUsage() error {
 	return err
 }
 
+func (s *SQLiteStore) Enqueue(token, role, device string, data []byte) error {
+	_, err := s.db.Exec("INSERT INTO mailbox (token, role, device, data) VALUES (?, ?, ?, ?)", token, role, device, data)
+	return err
+}
+
+func (s *SQLiteStore) Pending(token, role, device string, since time.Time) ([]QueuedMessage, error) {
+	rows, err := s.db.Query(
+		"SELECT id, device, data, created_at FROM mailbox WHERE token = ? AND role = ? AND device IN (?, '') AND created_at >= ? ORDER BY id",
+		token, role, device, since.UTC().Format("2006-01-02 15:04:05"),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var msgs []QueuedMessage
+	for rows.Next() {
+		var m QueuedMessage
+		if err := rows.Scan(&m.ID, &m.Device, &m.Data, &m.CreatedAt); err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, m)
+	}
+	return msgs, rows.Err()
+}
+
+func (s *SQLiteStore) Remove(id int64) error {
+	_, err := s.db.Exec("DELETE FROM mailbox WHERE id = ?", id)
+	return err
+}
+
+func (s *SQLiteStore) MailboxUsage(token, role string) (int, int64, error) {
+	var count int
+	var total sql.NullInt64
+	err := s.db.QueryRow(
+		"SELECT COUNT(*), SUM(LENGTH(data)) FROM mailbox WHERE token = ? AND role = ?",
+		token, role,
+	).Scan(&count, &total)
+	if err != nil {
+		return 0, 0, err
+	}
+	return count, total.Int64, nil
+}
+
+func (s *SQLiteStore) PurgeExpired(before time.Time) (int64, error) {
+	res, err := s.db.Exec("DELETE FROM mailbox WHERE created_at < ?", before.UTC().Format("2006-01-02 15:04:05"))
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (s *SQLiteStore) SetTakeoverPolicy(token, policy string) error {
+	_, err := s.db.Exec(`INSERT INTO token_policies (token, takeover) VALUES (?, ?)
+		ON CONFLICT(token) DO UPDATE SET takeover = excluded.takeover`, token, policy)
+	return err
+}
+
+func (s *SQLiteStore) TakeoverPolicy(token string) (string, error) {
+	var policy string
+	err := s.db.QueryRow("SELECT takeover FROM token_policies WHERE token = ?", token).Scan(&policy)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return policy, err
+}
+
 func (s *SQLiteStore) Close() error {
 	return s.db.Close()
 }
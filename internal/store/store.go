@@ -23,3 +23,33 @@ type TokenInfo struct {
 	Token     string
 	CreatedAt time.Time
 }
+
+// Mailbox queues envelopes for a peer that is offline so they can be replayed
+// when it reconnects. It is optional; stores that support it implement it
+// alongside Store.
+type Mailbox interface {
+	// Enqueue stores data for one device of role, or for whichever device
+	// comes first if device is "".
+	Enqueue(token, role, device string, data []byte) error
+	// Pending returns the entries for device and those for any device.
+	Pending(token, role, device string, since time.Time) ([]QueuedMessage, error)
+	Remove(id int64) error
+	MailboxUsage(token, role string) (count int, bytes int64, err error)
+	PurgeExpired(before time.Time) (int64, error)
+}
+
+// TokenPolicies stores per-token connection policies. Like Mailbox, it is
+// optional and implemented alongside Store.
+type TokenPolicies interface {
+	SetTakeoverPolicy(token, policy string) error
+	// TakeoverPolicy returns "" if none was set for the token.
+	TakeoverPolicy(token string) (string, error)
+}
+
+// QueuedMessage is an envelope waiting in a mailbox, oldest first.
+type QueuedMessage struct {
+	ID        int64
+	Device    string // "" for any device
+	Data      []byte
+	CreatedAt time.Time
+}